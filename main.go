@@ -1,10 +1,208 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/cloverstd/clash-mate/mate"
 )
 
+const usage = `Usage:
+  clash-mate [flags] [config]                   serve the rule providers
+  clash-mate generate [flags] <output> [config] write the rules to output and exit
+  clash-mate convert [flags] [config]           convert gfwlist from stdin to stdout
+  clash-mate dry-run [flags] [config]           print what would be served and exit
+  clash-mate validate <file>                    validate the local gfwlist file
+
+The config keys can be set by the CLASH_MATE_<KEY> environment variables, e.g.
+CLASH_MATE_INTERVAL=1h, which are overridden by the config file, which is
+overridden by the flags.
+
+Flags:
+`
+
 func main() {
-	s := mate.NewServer()
-	s.Start(9999)
+	var command string
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+	switch command {
+	case "generate":
+		f := parseFlags(command, os.Args[2:])
+		if f.fs.NArg() < 1 {
+			f.fs.Usage()
+			os.Exit(2)
+		}
+		generate(f.fs.Arg(0), f.mustLoad(f.fs.Arg(1)))
+	case "convert":
+		f := parseFlags(command, os.Args[2:])
+		convert(f.mustLoad(f.fs.Arg(0)))
+	case "dry-run", "--dry-run":
+		f := parseFlags(command, os.Args[2:])
+		dryRun(f.mustLoad(f.fs.Arg(0)))
+	case "validate":
+		if len(os.Args) < 3 {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(2)
+		}
+		validate(os.Args[2])
+	default:
+		f := parseFlags("serve", os.Args[1:])
+		serve(f, f.fs.Arg(0))
+	}
+}
+
+// flags are the command line flags, which override the config.
+type flags struct {
+	fs       *flag.FlagSet
+	config   string
+	port     int
+	interval time.Duration
+	url      string
+	proxy    string
+}
+
+func parseFlags(name string, args []string) *flags {
+	f := flags{fs: flag.NewFlagSet(name, flag.ExitOnError)}
+	f.fs.StringVar(&f.config, "config", "", "the config file, same as the config argument")
+	f.fs.IntVar(&f.port, "port", 0, "the port to listen on")
+	f.fs.DurationVar(&f.interval, "interval", 0, "the interval to update the gfwlist, e.g. 6h")
+	f.fs.StringVar(&f.url, "url", "", "the url to download the gfwlist from")
+	f.fs.StringVar(&f.proxy, "proxy", "", "the http or socks5 proxy to download the gfwlist")
+	f.fs.Usage = func() {
+		fmt.Fprint(f.fs.Output(), usage)
+		f.fs.PrintDefaults()
+	}
+	f.fs.Parse(args)
+	return &f
+}
+
+// load loads the config file, -config takes precedence over the file argument,
+// the config of the environment variables is used if neither is given. The
+// flags set override the config.
+func (f *flags) load(file string) (*mate.Config, error) {
+	if f.config != "" {
+		file = f.config
+	}
+	var (
+		cfg *mate.Config
+		err error
+	)
+	if file == "" {
+		cfg, err = mate.LoadEnvConfig()
+	} else {
+		cfg, err = mate.LoadConfig(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "port":
+			cfg.Port = f.port
+			cfg.Listen = ""
+		case "interval":
+			cfg.Interval = f.interval
+		case "url":
+			cfg.URL = f.url
+			cfg.File = ""
+		case "proxy":
+			cfg.Proxy = f.proxy
+		}
+	})
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (f *flags) mustLoad(file string) *mate.Config {
+	cfg, err := f.load(file)
+	if err != nil {
+		slog.Error("load config failed", "error", err)
+		os.Exit(1)
+	}
+	return cfg
+}
+
+func generate(output string, cfg *mate.Config) {
+	if err := mate.GenerateWithConfig(context.Background(), output, cfg); err != nil {
+		slog.Error("generate failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+func convert(cfg *mate.Config) {
+	if err := mate.ConvertWithConfig(os.Stdin, os.Stdout, cfg); err != nil {
+		slog.Error("convert failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+func dryRun(cfg *mate.Config) {
+	if err := mate.DryRunWithConfig(context.Background(), os.Stdout, cfg); err != nil {
+		slog.Error("dry run failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+func validate(file string) {
+	if err := mate.Validate(file, os.Stdout); err != nil {
+		slog.Error("validate failed", "file", file, "error", err)
+		os.Exit(1)
+	}
+}
+
+// start serves https if tls is configured, otherwise http on the address.
+func start(s *mate.Server, cfg *mate.Config) error {
+	switch {
+	case cfg.TLS.CertFile != "":
+		return s.StartTLS(cfg.Port, cfg.TLS.CertFile, cfg.TLS.KeyFile)
+	case len(cfg.TLS.AutoCert.Domains) > 0:
+		return s.StartAutoCert(cfg.TLS.AutoCertCacheDir(), cfg.TLS.AutoCert.Domains...)
+	}
+	return s.StartAddr(cfg.Addr())
+}
+
+// serve serves until SIGINT or SIGTERM, the config is reloaded on SIGHUP.
+func serve(f *flags, file string) {
+	cfg := f.mustLoad(file)
+	s, err := mate.NewServerWithConfig(cfg)
+	if err != nil {
+		slog.Error("create server failed", "error", err)
+		os.Exit(1)
+	}
+	go func() {
+		if err := start(s, cfg); err != nil {
+			slog.Error("start server failed", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range ch {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		cfg, err := f.load(file)
+		if err != nil {
+			slog.Error("reload config failed", "error", err)
+			continue
+		}
+		if err := s.Reload(cfg); err != nil {
+			slog.Error("reload server failed", "error", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		slog.Error("shutdown failed", "error", err)
+	}
 }
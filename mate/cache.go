@@ -0,0 +1,65 @@
+package mate
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// defaultCacheFile returns the cache file of the provider in the user cache
+// directory, or in the temporary directory if the former is unavailable. It's
+// keyed by the source too, so the cache of the old source isn't loaded after
+// the url or file is changed.
+func defaultCacheFile(name, source string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	sum := sha256.Sum256([]byte(source))
+	return filepath.Join(dir, "clash-mate", name+"-"+hex.EncodeToString(sum[:4])+".txt")
+}
+
+// saveCache writes the decoded gfwlist to the cache file, it's written to a
+// temporary file and renamed so a partial write never corrupts the cache.
+func (s *gfwlistProvider) saveCache(raw []byte) error {
+	if s.cacheFile == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(s.cacheFile), 0755); err != nil {
+		return err
+	}
+	tmp := s.cacheFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, raw, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.cacheFile)
+}
+
+// loadCache parses the cached gfwlist and serves it until the first update.
+func (s *gfwlistProvider) loadCache() error {
+	if s.cacheFile == "" {
+		return nil
+	}
+	stat, err := os.Stat(s.cacheFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	raw, err := ioutil.ReadFile(s.cacheFile)
+	if err != nil {
+		return err
+	}
+	proxyList, directList, err := s.parse(ioutil.NopCloser(bytes.NewReader(raw)))
+	if err != nil {
+		return err
+	}
+	s.recordParseStats()
+	s.setLists(proxyList, directList, stat.ModTime())
+	return nil
+}
@@ -0,0 +1,100 @@
+package mate
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	apnicDownloadURL      = "https://ftp.apnic.net/stats/apnic/delegated-apnic-latest"
+	chnroutesProviderName = "chnroutes"
+)
+
+// newChnroutesProvider creates the provider of the china ip allocations from
+// the APNIC delegated file, which should be routed directly.
+func newChnroutesProvider(opts ...Option) *gfwlistProvider {
+	return newGfwlistProvider(append([]Option{
+		WithName(chnroutesProviderName),
+		WithURL(apnicDownloadURL),
+		withParser(parseAPNIC),
+	}, opts...)...)
+}
+
+// parseAPNIC parses the CN ipv4 and ipv6 records of the APNIC delegated file,
+// e.g. apnic|CN|ipv4|1.0.1.0|256|20110414|allocated, the value of the ipv4
+// record is the number of the addresses while it's the prefix length for ipv6.
+func parseAPNIC(rc io.ReadCloser, decoded io.Writer) (proxyList ruleList, directList ruleList, stats parseStats, _ error) {
+	defer rc.Close()
+	var r io.Reader = rc
+	if decoded != nil {
+		r = io.TeeReader(r, decoded)
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		stats.total++
+		if strings.HasPrefix(line, "#") {
+			stats.comments++
+			continue
+		}
+		fields := strings.Split(line, "|")
+		if len(fields) < 5 || fields[1] != "CN" || (fields[2] != "ipv4" && fields[2] != "ipv6") {
+			stats.skipped++
+			continue
+		}
+		cidrs, err := apnicCIDRs(fields[2], fields[3], fields[4])
+		if err != nil {
+			stats.invalid++
+			continue
+		}
+		for _, cidr := range cidrs {
+			stats.add(ip)
+			proxyList.add(ip, cidr)
+		}
+	}
+	proxyList.normalize()
+	return proxyList, directList, stats, scanner.Err()
+}
+
+// apnicCIDRs converts the start and value of the APNIC record to the cidrs,
+// the ipv4 range may not be aligned to a single cidr so it's split.
+func apnicCIDRs(typ, start, value string) ([]string, error) {
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value: %s", value)
+	}
+	addr := net.ParseIP(start)
+	if typ == "ipv6" {
+		if addr == nil || addr.To4() != nil || n > 128 {
+			return nil, fmt.Errorf("invalid ipv6 record: %s/%s", start, value)
+		}
+		return []string{fmt.Sprintf("%s/%d", start, n)}, nil
+	}
+	if addr == nil || addr.To4() == nil || n == 0 || n > 1<<32 {
+		return nil, fmt.Errorf("invalid ipv4 record: %s/%s", start, value)
+	}
+	var cidrs []string
+	ip := uint64(binary.BigEndian.Uint32(addr.To4()))
+	for n > 0 {
+		// the largest block aligned to ip and not larger than n
+		size := uint64(1) << bits.TrailingZeros64(ip|1<<32)
+		for size > n {
+			size >>= 1
+		}
+		b := make(net.IP, 4)
+		binary.BigEndian.PutUint32(b, uint32(ip))
+		cidrs = append(cidrs, fmt.Sprintf("%s/%d", b, 32-bits.TrailingZeros64(size)))
+		ip += size
+		n -= size
+	}
+	return cidrs, nil
+}
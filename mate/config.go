@@ -0,0 +1,372 @@
+package mate
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v2"
+)
+
+const defaultPort = 9999
+
+// Config is the config of the whole server.
+type Config struct {
+	// Port is the port to listen on.
+	Port int `yaml:"port"`
+	// Listen overrides Port if set, it's either a tcp address like
+	// "127.0.0.1:9999" or a unix socket like "unix:///run/clash-mate.sock".
+	Listen string `yaml:"listen"`
+	// ProviderConfig is the config of the default gfwlist provider.
+	ProviderConfig `yaml:",inline"`
+	// Providers are the additional providers, each is served on its own path.
+	Providers []ProviderConfig `yaml:"providers"`
+	Auth      AuthConfig       `yaml:"auth"`
+	// AccessLog logs every request.
+	AccessLog bool `yaml:"access_log"`
+	// PprofAddr serves the profiles on /debug/pprof/ of its own listener, e.g.
+	// localhost:6060, which must be a loopback address or a unix socket,
+	// disabled when it's empty.
+	PprofAddr string `yaml:"pprof_addr"`
+	// CORSOrigins are the origins allowed to fetch the rules from the
+	// browsers, e.g. https://dashboard.example.com, * allows any origin.
+	CORSOrigins []string `yaml:"cors_origins"`
+	// ReadTimeout, WriteTimeout and IdleTimeout are the timeouts of the
+	// server, default to 10s, 1m and 2m.
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+	// MaxConcurrent limits the concurrent requests to the rules, unlimited
+	// by default.
+	MaxConcurrent int `yaml:"max_concurrent"`
+	// TLS serves https instead of http if it's set.
+	TLS TLSConfig `yaml:"tls"`
+}
+
+// TLSConfig serves https with either the certificate files or the certificates
+// obtained from Let's Encrypt, it's disabled when both are absent.
+type TLSConfig struct {
+	CertFile string         `yaml:"cert_file"`
+	KeyFile  string         `yaml:"key_file"`
+	AutoCert AutoCertConfig `yaml:"autocert"`
+}
+
+// AutoCertConfig obtains the certificates of the domains from Let's Encrypt,
+// which listens on 443 regardless of the port.
+type AutoCertConfig struct {
+	Domains []string `yaml:"domains"`
+	// CacheDir caches the certificates, defaults to the autocert directory in
+	// the user cache directory.
+	CacheDir string `yaml:"cache_dir"`
+}
+
+// types of the provider source.
+const (
+	providerTypeGfwlist   = "gfwlist"
+	providerTypeChnroutes = "chnroutes"
+	providerTypeEasylist  = "easylist"
+)
+
+// ProviderConfig is the config of a provider.
+type ProviderConfig struct {
+	// Name is the name of the provider, which is served on
+	// /clash/provider/<name>, defaults to the type.
+	Name string `yaml:"name"`
+	// Type is the source of the provider, gfwlist, chnroutes or easylist,
+	// defaults to gfwlist.
+	Type string `yaml:"type"`
+	// Interval is the interval to update the provider, e.g. 30m or 6h.
+	Interval time.Duration `yaml:"interval"`
+	// Cron schedules the updates with the standard cron spec instead of the
+	// interval, e.g. "0 4 * * *" for 4am daily.
+	Cron string `yaml:"cron"`
+	// Jitter randomizes each interval by up to the ratio of it, e.g. 0.1.
+	Jitter float64 `yaml:"jitter"`
+	// URL is the url to download the list from.
+	URL string `yaml:"url"`
+	// File reads the list from the local file instead of downloading it.
+	File string `yaml:"file"`
+	// MaxSize is the max size of the source in bytes, defaults to 50MB.
+	MaxSize int64 `yaml:"max_size"`
+	// Proxy is the http or socks5 proxy to download the list.
+	Proxy string `yaml:"proxy"`
+	// Format is the default output format when the format query is absent.
+	Format string `yaml:"format"`
+	// Exclude are the domains removed from the proxy rules with their
+	// subdomains.
+	Exclude []string `yaml:"exclude"`
+	// ForceSuffix are the domains rendered as DOMAIN-SUFFIX rules if they're
+	// present in the proxy rules in any form.
+	ForceSuffix []string `yaml:"force_suffix"`
+	// KeywordDenylist are the keywords removed from the proxy rules.
+	KeywordDenylist []string `yaml:"keyword_denylist"`
+	// MinKeywordLength removes the keywords shorter than it from the proxy
+	// rules.
+	MinKeywordLength int `yaml:"min_keyword_length"`
+	// CollapseSubdomains removes the suffixes covered by their parent
+	// suffixes, e.g. sub.example.com if example.com is present.
+	CollapseSubdomains bool `yaml:"collapse_subdomains"`
+	// Final appends MATCH,<final> after the classical clash rules, e.g.
+	// DIRECT.
+	Final string `yaml:"final"`
+	// CacheControl is the Cache-Control of the rules, e.g. max-age=3600,
+	// defaults to no-cache, auto caches the rules until the next update.
+	CacheControl string `yaml:"cache_control"`
+	// Raw serves the decoded source on /clash/provider/<name>/raw.
+	Raw bool `yaml:"raw"`
+	// NoResolve appends no-resolve to the ip rules, defaults to true.
+	NoResolve *bool `yaml:"no_resolve"`
+	// CustomRules are merged into the proxy rules, in the syntax of the
+	// gfwlist lines, e.g. ||example.com.
+	CustomRules []string `yaml:"custom_rules"`
+	// CustomRulesFile is merged into the proxy rules, one rule per line, it's
+	// read on each update.
+	CustomRulesFile string `yaml:"custom_rules_file"`
+	// DomainRegex translates the regex lines to DOMAIN-REGEX rules, which is
+	// only supported by clash-meta.
+	DomainRegex bool `yaml:"domain_regex"`
+	// CacheFile persists the last parsed source, empty disables it, defaults
+	// to a file in the user cache directory.
+	CacheFile *string `yaml:"cache_file"`
+	// RetryAttempts and RetryDelay retry the failed download with the
+	// exponential backoff, default to 3 and 1s.
+	RetryAttempts int           `yaml:"retry_attempts"`
+	RetryDelay    time.Duration `yaml:"retry_delay"`
+	// Timeout is the timeout of each download, defaults to 30s.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// AuthConfig is the basic auth of the provider endpoints, it's disabled when
+// the username is empty.
+type AuthConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// DefaultConfig returns the config used when no config file is given.
+func DefaultConfig() *Config {
+	return &Config{
+		Port: defaultPort,
+	}
+}
+
+// LoadConfig reads the yaml config file, the absent fields keep the values of
+// the environment variables, see LoadEnvConfig, or the default values.
+func LoadConfig(file string) (*Config, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read config failed, %w", err)
+	}
+	cfg, err := envConfig()
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(b, cfg); err != nil {
+		return nil, fmt.Errorf("parse config failed, %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// AutoCertCacheDir returns the directory caching the certificates of autocert.
+func (c *TLSConfig) AutoCertCacheDir() string {
+	if c.AutoCert.CacheDir != "" {
+		return c.AutoCert.CacheDir
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "clash-mate", "autocert")
+}
+
+// Addr returns the address to listen on, which is Listen if set or the Port.
+func (c *Config) Addr() string {
+	if c.Listen != "" {
+		return c.Listen
+	}
+	return fmt.Sprintf(":%d", c.Port)
+}
+
+// Validate checks the config, it should be called after the config is changed.
+func (c *Config) Validate() error {
+	if c.Port <= 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid port: %d", c.Port)
+	}
+	if c.ReadTimeout < 0 || c.WriteTimeout < 0 || c.IdleTimeout < 0 {
+		return fmt.Errorf("invalid timeout: %s, %s, %s", c.ReadTimeout, c.WriteTimeout, c.IdleTimeout)
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return fmt.Errorf("both cert_file and key_file of tls are required")
+	}
+	if c.TLS.CertFile != "" && len(c.TLS.AutoCert.Domains) > 0 {
+		return fmt.Errorf("the certificate files and autocert of tls are exclusive")
+	}
+	if c.Listen != "" && (c.TLS.CertFile != "" || len(c.TLS.AutoCert.Domains) > 0) {
+		return fmt.Errorf("tls listens on the port, listen is not supported")
+	}
+	if c.PprofAddr != "" {
+		if err := checkLocalAddr(c.PprofAddr); err != nil {
+			return err
+		}
+	}
+	names := map[string]bool{defaultProviderName: true}
+	if c.Name != "" && c.Name != defaultProviderName {
+		return fmt.Errorf("the name of the default provider must be %s", defaultProviderName)
+	}
+	if c.Type != "" && c.Type != providerTypeGfwlist {
+		return fmt.Errorf("the type of the default provider must be %s", providerTypeGfwlist)
+	}
+	if err := c.ProviderConfig.validate(); err != nil {
+		return err
+	}
+	for _, pc := range c.Providers {
+		name := pc.name()
+		if name == "" {
+			return fmt.Errorf("the name of provider is required")
+		}
+		if names[name] {
+			return fmt.Errorf("duplicated provider: %s", name)
+		}
+		names[name] = true
+		if err := pc.validate(); err != nil {
+			return err
+		}
+	}
+	// the direct rules of a provider are served on /clash/provider/<name>-direct
+	for name := range names {
+		if names[name+"-direct"] {
+			return fmt.Errorf("provider %s-direct collides with the direct rules of provider %s", name, name)
+		}
+	}
+	return nil
+}
+
+// name returns the name of the provider, which defaults to the type except
+// gfwlist since the default provider already takes it.
+func (c *ProviderConfig) name() string {
+	if c.Name == "" && c.Type != providerTypeGfwlist {
+		return c.Type
+	}
+	return c.Name
+}
+
+func (c *ProviderConfig) validate() error {
+	if strings.ContainsAny(c.Name, "/?#") {
+		return fmt.Errorf("invalid provider name: %s", c.Name)
+	}
+	switch c.Type {
+	case "", providerTypeGfwlist, providerTypeChnroutes, providerTypeEasylist:
+	default:
+		return fmt.Errorf("unknown provider type: %s", c.Type)
+	}
+	if c.Cron != "" {
+		if _, err := cron.ParseStandard(c.Cron); err != nil {
+			return fmt.Errorf("invalid cron: %s, %w", c.Cron, err)
+		}
+	}
+	if c.Jitter < 0 || c.Jitter >= 1 {
+		return fmt.Errorf("invalid jitter: %v, it should be in [0, 1)", c.Jitter)
+	}
+	if c.Format != "" && !isFormat(c.Format) {
+		return fmt.Errorf("unknown format: %s", c.Format)
+	}
+	return nil
+}
+
+// newProvider creates the provider of the type with the options of the config
+// and opts.
+func (c *ProviderConfig) newProvider(opts ...Option) *gfwlistProvider {
+	opts = append(c.options(), opts...)
+	switch c.Type {
+	case providerTypeChnroutes:
+		return newChnroutesProvider(opts...)
+	case providerTypeEasylist:
+		return newEasylistProvider(opts...)
+	}
+	return newGfwlistProvider(opts...)
+}
+
+// options returns the provider options of the config.
+func (c *ProviderConfig) options() []Option {
+	var opts []Option
+	if name := c.name(); name != "" {
+		opts = append(opts, WithName(name))
+	}
+	if c.Interval > 0 {
+		opts = append(opts, WithInterval(c.Interval))
+	}
+	if c.Cron != "" {
+		opts = append(opts, WithCron(c.Cron))
+	}
+	if c.Jitter > 0 {
+		opts = append(opts, WithJitter(c.Jitter))
+	}
+	if c.URL != "" {
+		opts = append(opts, WithURL(c.URL))
+	}
+	if c.File != "" {
+		opts = append(opts, WithFile(c.File))
+	}
+	if c.MaxSize > 0 {
+		opts = append(opts, WithMaxSize(c.MaxSize))
+	}
+	if c.Proxy != "" {
+		opts = append(opts, WithProxy(c.Proxy))
+	}
+	if c.Format != "" {
+		opts = append(opts, WithFormat(c.Format))
+	}
+	if len(c.Exclude) > 0 {
+		opts = append(opts, WithExcludeDomains(c.Exclude...))
+	}
+	if len(c.ForceSuffix) > 0 {
+		opts = append(opts, WithForceSuffixes(c.ForceSuffix...))
+	}
+	if len(c.KeywordDenylist) > 0 {
+		opts = append(opts, WithKeywordDenylist(c.KeywordDenylist...))
+	}
+	if c.MinKeywordLength > 0 {
+		opts = append(opts, WithMinKeywordLength(c.MinKeywordLength))
+	}
+	if c.CollapseSubdomains {
+		opts = append(opts, WithCollapseSubdomains())
+	}
+	if c.Final != "" {
+		opts = append(opts, WithFinalRule(c.Final))
+	}
+	if c.CacheControl != "" {
+		opts = append(opts, WithCacheControl(c.CacheControl))
+	}
+	if c.Raw {
+		opts = append(opts, WithRawEndpoint(true))
+	}
+	if c.NoResolve != nil {
+		opts = append(opts, WithNoResolve(*c.NoResolve))
+	}
+	if len(c.CustomRules) > 0 {
+		opts = append(opts, WithCustomRules(c.CustomRules...))
+	}
+	if c.CustomRulesFile != "" {
+		opts = append(opts, WithCustomRulesFile(c.CustomRulesFile))
+	}
+	if c.DomainRegex {
+		opts = append(opts, WithDomainRegex(true))
+	}
+	if c.CacheFile != nil {
+		opts = append(opts, WithCacheFile(*c.CacheFile))
+	}
+	if c.RetryAttempts > 0 || c.RetryDelay > 0 {
+		opts = append(opts, WithRetry(c.RetryAttempts, c.RetryDelay))
+	}
+	if c.Timeout > 0 {
+		opts = append(opts, WithTimeout(c.Timeout))
+	}
+	return opts
+}
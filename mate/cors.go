@@ -0,0 +1,59 @@
+package mate
+
+import (
+	"net/http"
+	"strings"
+)
+
+// corsMaxAge is how long the browsers cache the preflight result in seconds.
+const corsMaxAge = "86400"
+
+// SetCORSOrigins allows the origins to fetch the rules from the browsers, "*"
+// allows any origin without the credentials and empty disables CORS. It should
+// be called before Start.
+func (s *Server) SetCORSOrigins(origins []string) {
+	s.corsOrigins = make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		s.corsOrigins[strings.TrimSuffix(origin, "/")] = true
+	}
+}
+
+func (s *Server) allowOrigin(origin string) bool {
+	return origin != "" && (s.corsOrigins["*"] || s.corsOrigins[origin])
+}
+
+// wrapperCORSHandler sets the CORS headers for the allowed origins and answers
+// the preflight requests, which is done before the auth since the browsers
+// don't send the credentials in the preflight.
+func (s *Server) wrapperCORSHandler(f http.HandlerFunc) http.HandlerFunc {
+	return func(wr http.ResponseWriter, r *http.Request) {
+		if len(s.corsOrigins) == 0 {
+			f(wr, r)
+			return
+		}
+		wr.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		if !s.allowOrigin(origin) {
+			f(wr, r)
+			return
+		}
+		if s.corsOrigins[origin] {
+			// the listed origin is echoed so the credentials are allowed.
+			wr.Header().Set("Access-Control-Allow-Origin", origin)
+			wr.Header().Set("Access-Control-Allow-Credentials", "true")
+		} else {
+			// the wildcard never allows the credentials, otherwise any site
+			// could read the protected rules with the cached credentials.
+			wr.Header().Set("Access-Control-Allow-Origin", "*")
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			wr.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+			wr.Header().Set("Access-Control-Allow-Headers", "Authorization, If-None-Match, If-Modified-Since")
+			wr.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			wr.WriteHeader(http.StatusNoContent)
+			return
+		}
+		wr.Header().Set("Access-Control-Expose-Headers", "ETag, Last-Modified, X-Rules-Stale-Seconds, X-Rule-Count, X-Rule-Domains, X-Rule-Ips, X-Rule-Keywords, X-Rule-Format, X-Generated-At")
+		f(wr, r)
+	}
+}
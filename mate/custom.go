@@ -0,0 +1,66 @@
+package mate
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// mergeCustomRules parses the custom rules and the rules in the custom file,
+// then merges them into list. The custom rules use the same syntax as gfwlist
+// lines, such as example.com, ||example.com or 1.2.3.0/24, lines starting
+// with ! or # are skipped.
+func (s *gfwlistProvider) mergeCustomRules(list *ruleList) error {
+	defer list.normalize()
+	for _, rule := range s.customRules {
+		s.addCustomRule(list, rule)
+	}
+	if s.customRulesFile == "" {
+		return nil
+	}
+	f, err := os.Open(s.customRulesFile)
+	if err != nil {
+		return fmt.Errorf("open custom rules file failed, %w", err)
+	}
+	defer f.Close()
+	if stat, err := f.Stat(); err == nil {
+		s.customRulesModTime = stat.ModTime()
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		s.addCustomRule(list, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read custom rules file failed, %w", err)
+	}
+	return nil
+}
+
+func (s *gfwlistProvider) addCustomRule(list *ruleList, rule string) {
+	rule = strings.TrimSpace(rule)
+	if rule == "" || strings.HasPrefix(rule, "!") || strings.HasPrefix(rule, "#") {
+		return
+	}
+	typ, v := s.parseLine(rule)
+	if typ == unknown || (isDomain(typ) && !isValidDomain(v)) {
+		s.logger.Warn("skip invalid custom rule", "rule", rule)
+		return
+	}
+	list.add(typ, v)
+}
+
+// customRulesChanged reports whether the custom rules file is modified since
+// it's merged last time, so the unchanged source is parsed again to pick up
+// the changes.
+func (s *gfwlistProvider) customRulesChanged() bool {
+	if s.customRulesFile == "" {
+		return false
+	}
+	stat, err := os.Stat(s.customRulesFile)
+	if err != nil {
+		// the removed file is reported as an error by mergeCustomRules.
+		return true
+	}
+	return !stat.ModTime().Equal(s.customRulesModTime)
+}
@@ -0,0 +1,90 @@
+package mate
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+const (
+	easylistDownloadURL  = "https://easylist.to/easylist/easylist.txt"
+	easylistProviderName = "easylist"
+)
+
+// newEasylistProvider creates the provider of the ad domains from EasyList,
+// which should be rejected.
+func newEasylistProvider(opts ...Option) *gfwlistProvider {
+	return newGfwlistProvider(append([]Option{
+		WithName(easylistProviderName),
+		WithURL(easylistDownloadURL),
+		withParser(parseEasylist),
+	}, opts...)...)
+}
+
+// parseEasylist parses the domain anchored rules of EasyList, e.g.
+// ||ads.example.com^, the whole hostname is kept since blocking the
+// registrable domain would block the site itself. The rules matching the
+// paths and the element hiding rules can't be expressed by domain rules so
+// they're skipped, and the @@ exceptions go to the direct list.
+func parseEasylist(rc io.ReadCloser, decoded io.Writer) (proxyList ruleList, directList ruleList, stats parseStats, _ error) {
+	defer rc.Close()
+	var r io.Reader = rc
+	if decoded != nil {
+		r = io.TeeReader(r, decoded)
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		stats.total++
+		if line[0] == '!' || line[0] == '[' {
+			stats.comments++
+			continue
+		}
+		list := &proxyList
+		if strings.HasPrefix(line, "@@") {
+			line = strings.TrimPrefix(line, "@@")
+			list = &directList
+		}
+		typ, v := parseEasylistLine(line)
+		if typ == unknown {
+			stats.skipped++
+			continue
+		}
+		if isDomain(typ) && !isValidDomain(v) {
+			stats.invalid++
+			continue
+		}
+		if list == &directList {
+			stats.allowlist++
+		} else {
+			stats.add(typ)
+		}
+		list.add(typ, v)
+	}
+	proxyList.normalize()
+	directList.normalize()
+	return proxyList, directList, stats, scanner.Err()
+}
+
+// parseEasylistLine parses the ||hostname^ rule, the options after $ are
+// ignored since the whole domain is matched anyway.
+func parseEasylistLine(line string) (t, string) {
+	if strings.Contains(line, "#") || !strings.HasPrefix(line, "||") {
+		return unknown, ""
+	}
+	if i := strings.Index(line, "$"); i >= 0 {
+		line = line[:i]
+	}
+	hostname := strings.TrimSuffix(strings.TrimPrefix(line, "||"), "^")
+	if hostname == "" || strings.ContainsAny(hostname, "/^*|:") {
+		return unknown, ""
+	}
+	typ, v := tryGetDomain(hostname, true)
+	if typ != domain {
+		return unknown, ""
+	}
+	return domain, v
+}
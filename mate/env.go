@@ -0,0 +1,94 @@
+package mate
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix is the prefix of the environment variables of the config keys,
+// e.g. CLASH_MATE_INTERVAL for interval and CLASH_MATE_AUTH_USERNAME for
+// auth.username.
+const envPrefix = "CLASH_MATE_"
+
+// LoadEnvConfig returns the default config overridden by the environment
+// variables, it's used when no config file is given.
+func LoadEnvConfig() (*Config, error) {
+	cfg, err := envConfig()
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// envConfig returns the default config overridden by the environment
+// variables, PORT is used if CLASH_MATE_PORT is absent.
+func envConfig() (*Config, error) {
+	cfg := DefaultConfig()
+	if port, ok := os.LookupEnv("PORT"); ok {
+		if err := yaml.Unmarshal([]byte(port), &cfg.Port); err != nil {
+			return nil, fmt.Errorf("parse env PORT failed, %w", err)
+		}
+	}
+	if err := applyEnv(reflect.ValueOf(cfg).Elem(), envPrefix); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// applyEnv sets the fields of the struct from the environment variables named
+// by the prefix and the upper cased yaml keys, the lists are comma separated
+// and the lists of structs, i.e. the additional providers, are not supported.
+func applyEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, opts, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		fv := v.Field(i)
+		if opts == "inline" {
+			if err := applyEnv(fv, prefix); err != nil {
+				return err
+			}
+			continue
+		}
+		key := prefix + strings.ToUpper(name)
+		if fv.Kind() == reflect.Struct {
+			if err := applyEnv(fv, key+"_"); err != nil {
+				return err
+			}
+			continue
+		}
+		s, ok := os.LookupEnv(key)
+		if !ok {
+			continue
+		}
+		switch {
+		case fv.Kind() == reflect.String:
+			// set as is since the strings like cron specs aren't valid yaml.
+			fv.SetString(s)
+		case fv.Kind() == reflect.Pointer && fv.Type().Elem().Kind() == reflect.String:
+			// the empty string is set too, e.g. it disables the cache file.
+			fv.Set(reflect.ValueOf(&s))
+		case fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() == reflect.String:
+			var list []string
+			for _, item := range strings.Split(s, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			fv.Set(reflect.ValueOf(list))
+		case fv.Kind() == reflect.Slice:
+			return fmt.Errorf("env %s is not supported", key)
+		default:
+			if err := yaml.Unmarshal([]byte(s), fv.Addr().Interface()); err != nil {
+				return fmt.Errorf("parse env %s failed, %w", key, err)
+			}
+		}
+	}
+	return nil
+}
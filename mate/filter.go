@@ -0,0 +1,136 @@
+package mate
+
+import "strings"
+
+// forceSuffixes renders the forced domains as suffixes if they're present in
+// the list in any form, i.e. the exact domains equal to or under them and the
+// keywords of their first labels are replaced with the suffixes. It returns
+// the number of the replaced rules.
+func (s *gfwlistProvider) forceSuffixes(list *ruleList) int {
+	if len(s.forcedSuffixes) == 0 {
+		return 0
+	}
+	var replaced int
+	for _, suffix := range s.forcedSuffixes {
+		var n, m int
+		list.exacts, n = filterList(list.exacts, func(domain string) bool {
+			return domain == suffix || strings.HasSuffix(domain, "."+suffix)
+		})
+		list.keywords, m = filterList(list.keywords, func(keyword string) bool {
+			return strings.HasPrefix(suffix, keyword+".")
+		})
+		if n+m > 0 || containsSuffix(list.domains, suffix) {
+			list.domains = append(list.domains, suffix)
+		}
+		replaced += n + m
+	}
+	list.normalize()
+	return replaced
+}
+
+// containsSuffix reports whether any of the domains equals to or is under the
+// suffix.
+func containsSuffix(domains []string, suffix string) bool {
+	for _, domain := range domains {
+		if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludeDomains removes the domains which equal or are the subdomains of the
+// excluded domains from the list, it returns the number of the removed ones.
+func (s *gfwlistProvider) excludeDomains(list *ruleList) int {
+	if len(s.excludes) == 0 {
+		return 0
+	}
+	var removed int
+	list.domains, removed = filterList(list.domains, s.isExcluded)
+	var n int
+	list.exacts, n = filterList(list.exacts, s.isExcluded)
+	return removed + n
+}
+
+func (s *gfwlistProvider) isExcluded(domain string) bool {
+	for _, exclude := range s.excludes {
+		if domain == exclude || strings.HasSuffix(domain, "."+exclude) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterKeywords removes the denied keywords and the keywords shorter than the
+// min length, which are too broad to match, it returns the removed keywords.
+func (s *gfwlistProvider) filterKeywords(list *ruleList) []string {
+	if len(s.keywordDenylist) == 0 && s.minKeywordLength <= 0 {
+		return nil
+	}
+	var removed []string
+	list.keywords, _ = filterList(list.keywords, func(keyword string) bool {
+		if len(keyword) < s.minKeywordLength || s.keywordDenylist[keyword] {
+			removed = append(removed, keyword)
+			return true
+		}
+		return false
+	})
+	return removed
+}
+
+// filterList removes the values matching drop in place and returns the number
+// of the removed values.
+func filterList(list []string, drop func(string) bool) ([]string, int) {
+	kept := list[:0]
+	for _, v := range list {
+		if !drop(v) {
+			kept = append(kept, v)
+		}
+	}
+	return kept, len(list) - len(kept)
+}
+
+// dedup is the final pass over the merged list, it dedups each category and
+// removes the exact domains matched by the suffixes anyway. It returns the
+// number of the removed rules.
+func dedup(list *ruleList) int {
+	before := list.count()
+	list.normalize()
+	suffixes := make(map[string]bool, len(list.domains))
+	for _, domain := range list.domains {
+		suffixes[domain] = true
+	}
+	list.exacts, _ = filterList(list.exacts, func(domain string) bool {
+		return coveredBySuffix(domain, suffixes, true)
+	})
+	return before - list.count()
+}
+
+// collapseSubdomains removes the suffixes covered by their parent suffixes in
+// the list, it returns the number of the removed ones.
+func collapseSubdomains(list *ruleList) int {
+	suffixes := make(map[string]bool, len(list.domains))
+	for _, domain := range list.domains {
+		suffixes[domain] = true
+	}
+	var removed int
+	list.domains, removed = filterList(list.domains, func(domain string) bool {
+		return coveredBySuffix(domain, suffixes, false)
+	})
+	return removed
+}
+
+// coveredBySuffix reports whether any parent of the domain is in the suffixes,
+// the domain itself is checked too if self is true.
+func coveredBySuffix(domain string, suffixes map[string]bool, self bool) bool {
+	if self && suffixes[domain] {
+		return true
+	}
+	for i := strings.IndexByte(domain, '.'); i >= 0; i = strings.IndexByte(domain, '.') {
+		domain = domain[i+1:]
+		if suffixes[domain] {
+			return true
+		}
+	}
+	return false
+}
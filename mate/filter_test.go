@@ -0,0 +1,75 @@
+package mate
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+const keywordGFWList = `[AutoProxy 0.2.9]
+.google.*
+.yt.*
+||example.com
+`
+
+func convertString(test *testing.T, src string, opts ...Option) string {
+	test.Helper()
+	var buf bytes.Buffer
+	opts = append([]Option{WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))}, opts...)
+	if err := Convert(strings.NewReader(src), &buf, opts...); err != nil {
+		test.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestKeywordRules(test *testing.T) {
+	out := convertString(test, keywordGFWList)
+	for _, rule := range []string{"DOMAIN-KEYWORD,google", "DOMAIN-KEYWORD,yt", "DOMAIN-SUFFIX,example.com"} {
+		if !strings.Contains(out, "- "+rule+"\n") {
+			test.Errorf("%s is not emitted:\n%s", rule, out)
+		}
+	}
+}
+
+func TestFilterKeywords(test *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []Option
+		kept    []string
+		dropped []string
+	}{
+		{
+			name:    "denylist",
+			opts:    []Option{WithKeywordDenylist("google")},
+			kept:    []string{"DOMAIN-KEYWORD,yt"},
+			dropped: []string{"DOMAIN-KEYWORD,google"},
+		},
+		{
+			name:    "min length",
+			opts:    []Option{WithMinKeywordLength(3)},
+			kept:    []string{"DOMAIN-KEYWORD,google"},
+			dropped: []string{"DOMAIN-KEYWORD,yt"},
+		},
+		{
+			name:    "force suffix",
+			opts:    []Option{WithForceSuffixes("google.com")},
+			kept:    []string{"DOMAIN-SUFFIX,google.com", "DOMAIN-KEYWORD,yt"},
+			dropped: []string{"DOMAIN-KEYWORD,google"},
+		},
+	}
+	for _, tt := range tests {
+		out := convertString(test, keywordGFWList, tt.opts...)
+		for _, rule := range tt.kept {
+			if !strings.Contains(out, "- "+rule+"\n") {
+				test.Errorf("%s: %s is dropped:\n%s", tt.name, rule, out)
+			}
+		}
+		for _, rule := range tt.dropped {
+			if strings.Contains(out, "- "+rule+"\n") {
+				test.Errorf("%s: %s is not dropped:\n%s", tt.name, rule, out)
+			}
+		}
+	}
+}
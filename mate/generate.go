@@ -0,0 +1,134 @@
+package mate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Generate downloads and parses gfwlist once, then writes the rules in the
+// default format to outputPath, without starting any background update or
+// server. It's useful to generate a static rule provider periodically.
+func Generate(ctx context.Context, outputPath string, opts ...Option) error {
+	s := newGfwlistProvider(append([]Option{WithCacheFile("")}, opts...)...)
+	if err := s.update(ctx); err != nil {
+		return err
+	}
+	rules := s.loadRules()
+	_, b, _, err := s.render(rules.proxyList, url.Values{}, rules.updatedAt)
+	if err != nil {
+		return err
+	}
+	tmp := outputPath + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, outputPath)
+}
+
+// GenerateWithConfig is like Generate but uses the default gfwlist provider of
+// the config.
+func GenerateWithConfig(ctx context.Context, outputPath string, cfg *Config, opts ...Option) error {
+	return Generate(ctx, outputPath, append(cfg.ProviderConfig.options(), opts...)...)
+}
+
+// Convert reads gfwlist from r and writes the rules in the default format to
+// w, neither network nor cache is involved so it can be used in pipelines.
+func Convert(r io.Reader, w io.Writer, opts ...Option) error {
+	s := newGfwlistProvider(append([]Option{WithCacheFile("")}, opts...)...)
+	list, _, err := s.parse(ioutil.NopCloser(r))
+	if err != nil {
+		return err
+	}
+	_, b, _, err := s.render(list, url.Values{}, time.Now())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// ConvertWithConfig is like Convert but uses the default gfwlist provider of
+// the config.
+func ConvertWithConfig(r io.Reader, w io.Writer, cfg *Config, opts ...Option) error {
+	return Convert(r, w, append(cfg.ProviderConfig.options(), opts...)...)
+}
+
+// drySampleSize is the number of the rules of each type printed by DryRun.
+const drySampleSize = 5
+
+// DryRun downloads and parses gfwlist once like Generate, then writes the
+// statistics and a sample of each type of the rules to w instead of writing
+// the rules, it's useful to validate a new source.
+func DryRun(ctx context.Context, w io.Writer, opts ...Option) error {
+	s := newGfwlistProvider(append([]Option{WithCacheFile("")}, opts...)...)
+	if err := s.update(ctx); err != nil {
+		return err
+	}
+	rules := s.loadRules()
+	s.mu.RLock()
+	stats := s.stats
+	s.mu.RUnlock()
+	writeSummary(w, rules.proxyList, rules.directList, stats)
+	return nil
+}
+
+// DryRunWithConfig is like DryRun but uses the default gfwlist provider of the
+// config.
+func DryRunWithConfig(ctx context.Context, w io.Writer, cfg *Config, opts ...Option) error {
+	return DryRun(ctx, w, append(cfg.ProviderConfig.options(), opts...)...)
+}
+
+// writeSummary writes the statistics of the parse and a sample of each type of
+// the rules.
+func writeSummary(w io.Writer, proxyList, directList ruleList, stats parseStats) {
+	fmt.Fprintf(w, "lines: %d, comments: %d, skipped: %d, reserved: %d, invalid: %d\n",
+		stats.total, stats.comments, stats.skipped, stats.reserved, stats.invalid)
+	for _, category := range []struct {
+		name  string
+		rules []string
+	}{
+		{"domains", proxyList.domains},
+		{"exact domains", proxyList.exacts},
+		{"ips", proxyList.ips},
+		{"keywords", proxyList.keywords},
+		{"regexes", proxyList.regexes},
+	} {
+		fmt.Fprintf(w, "%s: %d\n", category.name, len(category.rules))
+		for i, rule := range category.rules {
+			if i == drySampleSize {
+				fmt.Fprintf(w, "  ...\n")
+				break
+			}
+			fmt.Fprintf(w, "  %s\n", rule)
+		}
+	}
+	fmt.Fprintf(w, "direct rules: %d\n", directList.count())
+}
+
+// Validate parses the local gfwlist file, either base64 encoded or plain, and
+// writes the summary like DryRun, it fails if the file can't be parsed or
+// yields no rules.
+func Validate(file string, w io.Writer, opts ...Option) error {
+	s := newGfwlistProvider(append(append([]Option{WithCacheFile("")}, opts...), WithFile(file))...)
+	body, err := s.download(context.Background())
+	if err != nil {
+		return err
+	}
+	proxyList, directList, err := s.parse(body)
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	stats := s.stats
+	s.mu.RUnlock()
+	writeSummary(w, proxyList, directList, stats)
+	if proxyList.count() == 0 {
+		return fmt.Errorf("no rules parsed from %s", file)
+	}
+	return nil
+}
@@ -2,23 +2,53 @@ package mate
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"math"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"runtime/debug"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"gopkg.in/yaml.v2"
+	"github.com/robfig/cron/v3"
+	"golang.org/x/net/idna"
+	"golang.org/x/net/proxy"
+	"golang.org/x/net/publicsuffix"
+	"golang.org/x/sync/singleflight"
 )
 
 const gfwlistDownloadURL = "https://raw.githubusercontent.com/gfwlist/gfwlist/master/gfwlist.txt"
 const defaultInterval = time.Hour
+const defaultRetryAttempts = 3
+const defaultRetryDelay = time.Second
+const defaultTimeout = 30 * time.Second
+const defaultMaxSize = 50 << 20
+const defaultProviderName = "gfwlist"
+
+// maxRuleDrop is the max ratio of the rules allowed to drop in an update,
+// more than that is likely caused by a truncated or mangled upstream.
+const maxRuleDrop = 0.5
+
+// errNotModified is returned by download when gfwlist is not modified since
+// the last successful update.
+var errNotModified = errors.New("gfwlist not modified")
 
 type t int
 
@@ -27,8 +57,17 @@ const (
 	ip
 	domain
 	domainKeyword
+	domainRegex
+	// domainExact matches the domain exactly, it's parsed from the lines
+	// anchored with a single |.
+	domainExact
 )
 
+// isDomain reports whether the type is a domain, which should be validated.
+func isDomain(typ t) bool {
+	return typ == domain || typ == domainExact
+}
+
 func uniqueList(list []string) []string {
 	m := make(map[string]bool, len(list))
 	var newList []string
@@ -42,144 +81,1009 @@ func uniqueList(list []string) []string {
 	return newList
 }
 
+func sortedList(list []string) []string {
+	sort.Strings(list)
+	return list
+}
+
+// ruleList is the parsed gfwlist grouped by rule type.
+type ruleList struct {
+	domains  []string
+	ips      []string
+	keywords []string
+	regexes  []string
+	// exacts are the domains matched exactly instead of as suffix.
+	exacts []string
+}
+
+func (l *ruleList) add(typ t, v string) {
+	switch typ {
+	case ip:
+		l.ips = append(l.ips, v)
+	case domain:
+		l.domains = append(l.domains, strings.ToLower(v))
+	case domainKeyword:
+		l.keywords = append(l.keywords, strings.ToLower(v))
+	case domainRegex:
+		l.regexes = append(l.regexes, v)
+	case domainExact:
+		l.exacts = append(l.exacts, strings.ToLower(v))
+	}
+}
+
+func (l *ruleList) count() int {
+	return len(l.domains) + len(l.ips) + len(l.keywords) + len(l.regexes) + len(l.exacts)
+}
+
+// normalize deduplicates and sorts each category so the output is
+// deterministic.
+func (l *ruleList) normalize() {
+	l.domains = sortedList(uniqueList(l.domains))
+	l.ips = sortedList(uniqueList(l.ips))
+	l.keywords = sortedList(uniqueList(l.keywords))
+	l.regexes = sortedList(uniqueList(l.regexes))
+	l.exacts = sortedList(uniqueList(l.exacts))
+}
+
+// hash writes each category of the normalized list to h, so the same rules
+// yield the same hash regardless of the order in the source.
+func (l *ruleList) hash(h hash.Hash) {
+	for _, category := range [][]string{l.domains, l.ips, l.keywords, l.regexes, l.exacts} {
+		for _, v := range category {
+			h.Write([]byte(v))
+			h.Write([]byte{'\n'})
+		}
+		// separates the categories
+		h.Write([]byte{0})
+	}
+}
+
+// hashLists returns the hash of the proxy and direct lists.
+func hashLists(proxyList, directList ruleList) string {
+	h := sha256.New()
+	proxyList.hash(h)
+	directList.hash(h)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
 type gfwlistProvider struct {
+	// name identifies the provider, it's used in the path and the metrics.
+	name     string
 	interval time.Duration
+	url      string
+	file     string
+	proxy    string
+	timeout  time.Duration
+	client   *http.Client
+
+	// customRules and the rules in customRulesFile are merged into the proxy
+	// rules.
+	customRules     []string
+	customRulesFile string
+	// customRulesModTime is the modification time of customRulesFile when
+	// it's merged last time.
+	customRulesModTime time.Time
+	// excludes are removed from the domains of the proxy rules with their
+	// subdomains.
+	excludes []string
+	// forcedSuffixes are rendered as DOMAIN-SUFFIX if they're present in the
+	// proxy rules in any form.
+	forcedSuffixes []string
+	// keywordDenylist and the keywords shorter than minKeywordLength are
+	// removed from the proxy rules since they match too broadly.
+	keywordDenylist  map[string]bool
+	minKeywordLength int
+	// collapseSubdomains removes the suffixes covered by their parent
+	// suffixes.
+	collapseSubdomains bool
+
+	// cacheFile persists the last successfully parsed gfwlist, disabled when
+	// it's empty, defaults to a file named after the provider and the source in
+	// the user cache directory.
+	cacheFile    string
+	cacheFileSet bool
+
+	retryAttempts int
+	retryDelay    time.Duration
+	// maxSize is the max size of the downloaded source in bytes, defaults to
+	// 50MB.
+	maxSize int64
 
-	mu    sync.RWMutex
-	rules []byte
+	// cron schedules the updates instead of the interval when it's not empty,
+	// e.g. "0 4 * * *" for 4am daily.
+	cron     string
+	schedule cron.Schedule
+
+	// jitterRatio randomizes each interval by up to the ratio of it, e.g. 0.1
+	// for ±10%, disabled when it's zero.
+	jitterRatio float64
+
+	// format is the default output format, defaults to clash.
+	format string
+	// finalPolicy appends MATCH,<finalPolicy> after the classical rules so the
+	// output is a complete rules section, disabled when it's empty.
+	finalPolicy string
+	// cacheControl is the Cache-Control of the rules, defaults to no-cache,
+	// auto derives the max-age from the next update.
+	cacheControl string
+	// serveRaw serves the decoded gfwlist for troubleshooting.
+	serveRaw bool
+
+	// parseSource parses the downloaded source to the rules, defaults to
+	// parseToList which parses gfwlist.
+	parseSource func(rc io.ReadCloser, decoded io.Writer) (proxyList, directList ruleList, stats parseStats, _ error)
+
+	// domainRegex translates the regex lines to DOMAIN-REGEX rules, which is
+	// only supported by clash-meta.
+	domainRegex bool
+	// noResolve appends no-resolve to the ip rules, defaults to true since
+	// the ips of gfwlist are the destination ips and resolving is pointless.
+	noResolve bool
+
+	// validators of the last successful update, used for conditional requests.
+	etag         string
+	lastModified string
+	// fetchedCount is the proxy rule count of the last successful update of
+	// the provider itself, the rules inherited on reload or loaded from the
+	// cache may come from another source or options so they're not compared
+	// by checkRuleCount.
+	fetchedCount int
+
+	// loopCtx is the context of the update loop, it bounds the updates
+	// triggered by the requests which must not be canceled by the clients.
+	loopCtx context.Context
+	cancel  context.CancelFunc
+	// done is closed once the update loop exits.
+	done chan struct{}
+
+	// logger has the provider attribute, rootLogger is the one without it
+	// which is shared with the server.
+	logger     *slog.Logger
+	rootLogger *slog.Logger
+
+	// group makes the concurrent updates share a single download.
+	group singleflight.Group
+
+	// rules is swapped wholesale on update so the handlers load it without
+	// any lock.
+	rules atomic.Pointer[ruleSet]
+
+	mu sync.RWMutex
+	// lastError is the error of the last update, nil if it succeeded.
+	lastError  error
+	nextUpdate time.Time
+	// lastDuration is how long the last update took, it's used to tell the
+	// clients when to retry before the rules are ready.
+	lastDuration time.Duration
+	// lastSuccess is the time of the last successful update, including the
+	// ones not changing the rules.
+	lastSuccess time.Time
+	// failures counts the consecutive failed updates.
+	failures int
+	// raw is the decoded gfwlist of the last parse, it's kept only when
+	// serveRaw or the cache is enabled, the cache file saves it as is.
+	raw []byte
+	// stats is the statistics of the last parse.
+	stats parseStats
 }
 
-func (s *gfwlistProvider) Handle(wr http.ResponseWriter) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	wr.Write(s.rules)
+// ruleSet is the snapshot of the rules of an update.
+type ruleSet struct {
+	proxyList  ruleList
+	directList ruleList
+	// updatedAt is the time of the last successful update, it's zero before
+	// the first successful update.
+	updatedAt time.Time
+	// hash is the hash of the lists, an update yielding the same hash is not
+	// swapped so the updatedAt and the rendered outputs are kept.
+	hash string
+
+	proxyCache  renderCache
+	directCache renderCache
+	ipCache     renderCache
+	domainCache renderCache
+}
+
+// loadRules returns the current rules, which is empty before the first
+// successful update.
+func (s *gfwlistProvider) loadRules() *ruleSet {
+	if rules := s.rules.Load(); rules != nil {
+		return rules
+	}
+	return &ruleSet{}
 }
 
-func (s *gfwlistProvider) renderClashRules(domainList, ipList, domainKeywordList []string) []string {
-	rules := make([]string, 0, len(domainList)+len(ipList)+len(domainKeywordList))
+func (s *gfwlistProvider) Name() string {
+	return s.name
+}
 
-	for _, domainKeyword := range domainKeywordList {
-		rules = append(rules, fmt.Sprintf("DOMAIN-KEYWORD,%s", domainKeyword))
+func (s *gfwlistProvider) Ready() bool {
+	return !s.loadRules().updatedAt.IsZero()
+}
+
+func (s *gfwlistProvider) Handle(wr http.ResponseWriter, r *http.Request) {
+	rules := s.loadRules()
+	if rules.updatedAt.IsZero() {
+		s.serveNotReady(wr)
+		return
 	}
-	for _, ip := range ipList {
-		rules = append(rules, fmt.Sprintf("SRC-IP-CIDR,%s/32", ip))
+	s.serve(wr, r, rules.proxyList, &rules.proxyCache, rules.updatedAt)
+}
+
+// HandleDirect serves the rules parsed from the @@ allowlist of gfwlist,
+// which should be routed directly.
+func (s *gfwlistProvider) HandleDirect(wr http.ResponseWriter, r *http.Request) {
+	rules := s.loadRules()
+	if rules.updatedAt.IsZero() {
+		s.serveNotReady(wr)
+		return
 	}
-	for _, domain := range domainList {
-		rules = append(rules, fmt.Sprintf("DOMAIN-SUFFIX,%s", domain))
+	s.serve(wr, r, rules.directList, &rules.directCache, rules.updatedAt)
+}
+
+// HandleIP serves only the ip rules, with the ipcidr behavior by default.
+func (s *gfwlistProvider) HandleIP(wr http.ResponseWriter, r *http.Request) {
+	rules := s.loadRules()
+	if rules.updatedAt.IsZero() {
+		s.serveNotReady(wr)
+		return
 	}
+	list := ruleList{ips: rules.proxyList.ips}
+	s.serve(wr, withDefaultQuery(r, "behavior", behaviorIPCIDR), list, &rules.ipCache, rules.updatedAt)
+}
+
+// HandleDomain serves only the domain rules, with the domain behavior by
+// default.
+func (s *gfwlistProvider) HandleDomain(wr http.ResponseWriter, r *http.Request) {
+	rules := s.loadRules()
+	if rules.updatedAt.IsZero() {
+		s.serveNotReady(wr)
+		return
+	}
+	list := ruleList{domains: rules.proxyList.domains, exacts: rules.proxyList.exacts}
+	s.serve(wr, withDefaultQuery(r, "behavior", behaviorDomain), list, &rules.domainCache, rules.updatedAt)
+}
 
-	return rules
+// HandleRaw serves the decoded gfwlist of the last parse.
+func (s *gfwlistProvider) HandleRaw(wr http.ResponseWriter, r *http.Request) {
+	if !s.serveRaw {
+		http.NotFound(wr, r)
+		return
+	}
+	s.mu.RLock()
+	raw := s.raw
+	s.mu.RUnlock()
+	if raw == nil {
+		s.serveNotReady(wr)
+		return
+	}
+	wr.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writeBody(wr, r, raw)
 }
 
-func (s *gfwlistProvider) update() error {
-	rc, err := s.download()
+func (s *gfwlistProvider) update(ctx context.Context) error {
+	body, err := s.download(ctx)
+	if errors.Is(err, errNotModified) {
+		if !s.customRulesChanged() {
+			s.logger.Info("gfwlist not modified, keep the current rules", "event", "update_not_modified")
+			return nil
+		}
+		// downloads unconditionally to merge the changed custom rules.
+		s.etag, s.lastModified = "", ""
+		body, err = s.download(ctx)
+	}
 	if err != nil {
 		return err
 	}
-	domain, ip, domainKeyword, err := s.parseToList(rc)
+	proxyList, directList, err := s.parse(body)
 	if err != nil {
 		return err
 	}
+	s.recordParseStats()
+	if err := s.checkRuleCount(proxyList.count()); err != nil {
+		return err
+	}
 
-	rules := s.renderClashRules(domain, ip, domainKeyword)
-	b, err := yaml.Marshal(map[string]interface{}{
-		"payload": rules,
-	})
+	s.etag = body.etag
+	s.lastModified = body.lastModified
+	s.fetchedCount = proxyList.count()
+	if hashLists(proxyList, directList) == s.loadRules().hash {
+		s.logger.Info("gfwlist changed but the rules are the same, keep the current rules", "event", "update_no_change")
+		return nil
+	}
+	s.setLists(proxyList, directList, time.Now())
+	s.mu.RLock()
+	raw := s.raw
+	s.mu.RUnlock()
+	if err := s.saveCache(raw); err != nil {
+		s.logger.Warn("save gfwlist cache failed", "event", "save_cache", "error", err)
+	}
+	return nil
+}
+
+// safeUpdate recovers the panic of update as an error, so a malformed line
+// won't stop the update loop.
+func (s *gfwlistProvider) safeUpdate(ctx context.Context) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.logger.Error("update gfwlist panicked", "event", "update_panic", "panic", r, "stack", string(debug.Stack()))
+			err = fmt.Errorf("update gfwlist panicked: %v", r)
+		}
+	}()
+	return s.update(ctx)
+}
+
+// checkRuleCount guards against the upstream corruption, the update is rejected
+// and the current rules are kept if it yields no rules or drops too many since
+// the last update of the provider itself.
+func (s *gfwlistProvider) checkRuleCount(count int) error {
+	current := s.fetchedCount
+	if count == 0 {
+		s.logger.Warn("update yields no rules, keep the current rules", "event", "update_rejected", "current_rule_count", current)
+		return errors.New("update yields no rules")
+	}
+	if current > 0 && float64(current-count) > float64(current)*maxRuleDrop {
+		s.logger.Warn("update drops too many rules, keep the current rules", "event", "update_rejected", "rule_count", count, "current_rule_count", current)
+		return fmt.Errorf("update drops too many rules, from %d to %d", current, count)
+	}
+	return nil
+}
+
+// parse parses the raw gfwlist and merges the custom rules into it, the
+// statistics are kept in s.stats and reported by recordParseStats, so the
+// library entry points don't touch the logs and the metrics.
+func (s *gfwlistProvider) parse(rc io.ReadCloser) (proxyList ruleList, directList ruleList, _ error) {
+	var decoded io.Writer
+	var raw bytes.Buffer
+	keepRaw := s.serveRaw || s.cacheFile != ""
+	if keepRaw {
+		decoded = &raw
+	}
+	proxyList, directList, stats, err := s.parseSource(rc, decoded)
 	if err != nil {
-		return err
+		return proxyList, directList, err
+	}
+	if keepRaw {
+		s.mu.Lock()
+		s.raw = raw.Bytes()
+		s.mu.Unlock()
+	}
+	if err := s.mergeCustomRules(&proxyList); err != nil {
+		return proxyList, directList, err
 	}
+	stats.forced = s.forceSuffixes(&proxyList)
+	stats.excluded = s.excludeDomains(&proxyList)
+	stats.suppressed = s.filterKeywords(&proxyList)
+	if s.collapseSubdomains {
+		stats.collapsed = collapseSubdomains(&proxyList) + collapseSubdomains(&directList)
+	}
+	stats.deduped = dedup(&proxyList) + dedup(&directList)
 	s.mu.Lock()
-	s.rules = b
+	s.stats = stats
 	s.mu.Unlock()
-	return nil
+	return proxyList, directList, nil
+}
+
+// recordParseStats logs the statistics of the last parse and exports them to
+// the metrics, it's called by the provider on update.
+func (s *gfwlistProvider) recordParseStats() {
+	s.mu.RLock()
+	stats := s.stats
+	s.mu.RUnlock()
+	s.logger.Info("parse gfwlist", "event", "parse",
+		"total", stats.total, "domains", stats.domains, "ips", stats.ips,
+		"keywords", stats.keywords, "regexes", stats.regexes, "exacts", stats.exacts, "allowlist", stats.allowlist,
+		"comments", stats.comments, "skipped", stats.skipped, "reserved", stats.reserved,
+		"invalid", stats.invalid)
+	if stats.forced > 0 {
+		s.logger.Info("force suffixes", "event", "force_suffix", "count", stats.forced)
+	}
+	if stats.excluded > 0 {
+		s.logger.Info("exclude domains", "event", "exclude", "count", stats.excluded)
+	}
+	if len(stats.suppressed) > 0 {
+		s.logger.Info("suppress keywords", "event", "suppress_keywords", "keywords", stats.suppressed)
+	}
+	if stats.collapsed > 0 {
+		s.logger.Info("collapse subdomains", "event", "collapse_subdomains", "count", stats.collapsed)
+	}
+	if stats.deduped > 0 {
+		s.logger.Info("dedup rules", "event", "dedup", "count", stats.deduped)
+	}
+	parseLines.WithLabelValues(s.name, "total").Set(float64(stats.total))
+	parseLines.WithLabelValues(s.name, "domain").Set(float64(stats.domains))
+	parseLines.WithLabelValues(s.name, "ip").Set(float64(stats.ips))
+	parseLines.WithLabelValues(s.name, "keyword").Set(float64(stats.keywords))
+	parseLines.WithLabelValues(s.name, "regex").Set(float64(stats.regexes))
+	parseLines.WithLabelValues(s.name, "exact").Set(float64(stats.exacts))
+	parseLines.WithLabelValues(s.name, "allowlist").Set(float64(stats.allowlist))
+	parseLines.WithLabelValues(s.name, "comment").Set(float64(stats.comments))
+	parseLines.WithLabelValues(s.name, "skipped").Set(float64(stats.skipped))
+	parseLines.WithLabelValues(s.name, "reserved").Set(float64(stats.reserved))
+	parseLines.WithLabelValues(s.name, "invalid").Set(float64(stats.invalid))
+}
+
+func (s *gfwlistProvider) setLists(proxyList, directList ruleList, updatedAt time.Time) {
+	s.rules.Store(&ruleSet{
+		proxyList:  proxyList,
+		directList: directList,
+		updatedAt:  updatedAt,
+		hash:       hashLists(proxyList, directList),
+	})
+	rulesCount.WithLabelValues(s.name, "domain").Set(float64(len(proxyList.domains)))
+	rulesCount.WithLabelValues(s.name, "ip").Set(float64(len(proxyList.ips)))
+	rulesCount.WithLabelValues(s.name, "keyword").Set(float64(len(proxyList.keywords)))
+	rulesCount.WithLabelValues(s.name, "exact").Set(float64(len(proxyList.exacts)))
+}
+
+// inheritRules starts with the rules of the provider it replaces on reload, so
+// the rules are served until the first update. The rendered outputs are not
+// inherited since the options may change.
+func (s *gfwlistProvider) inheritRules(old Provider) {
+	o, ok := old.(*gfwlistProvider)
+	if !ok {
+		return
+	}
+	if rules := o.rules.Load(); rules != nil {
+		s.setLists(rules.proxyList, rules.directList, rules.updatedAt)
+	}
 }
 
-func (s *gfwlistProvider) start() {
-	update := func() {
+// ruleCount returns the number of the current proxy rules.
+func (s *gfwlistProvider) ruleCount() int {
+	return s.loadRules().proxyList.count()
+}
+
+// Refresh updates the rules and records the result, the concurrent calls share
+// the result of the in-flight update.
+func (s *gfwlistProvider) Refresh(ctx context.Context) error {
+	_, err, _ := s.group.Do("update", func() (interface{}, error) {
+		// the update is shared, so it's canceled by Stop instead of the caller
+		ctx, cancel := s.updateContext(ctx)
+		defer cancel()
 		start := time.Now()
-		err := s.update()
+		err := s.safeUpdate(ctx)
+		duration := time.Now().Sub(start)
+		updateDuration.WithLabelValues(s.name).Observe(duration.Seconds())
+		s.mu.Lock()
+		s.lastError = err
+		s.lastDuration = duration
+		if err != nil {
+			s.failures++
+		} else {
+			s.failures = 0
+			s.lastSuccess = time.Now()
+		}
+		failures := s.failures
+		s.mu.Unlock()
 		if err != nil {
-			log.Println("update gfwlist failed, ", err)
+			updatesTotal.WithLabelValues(s.name, "failure").Inc()
+			s.logger.Error("update gfwlist failed", "event", "update_failed", "duration", duration, "failures", failures, "error", err)
+			if stale := s.staleness(); stale > s.staleThreshold() {
+				s.logger.Error("rules are stale, serving the old rules", "event", "rules_stale", "stale", stale.Round(time.Second), "failures", failures)
+			}
 		} else {
-			log.Println("update success, ", time.Now().Sub(start))
+			updatesTotal.WithLabelValues(s.name, "success").Inc()
+			lastSuccessTimestamp.WithLabelValues(s.name).Set(float64(time.Now().Unix()))
+			s.logger.Info("update success", "event", "update_success", "duration", duration, "rule_count", s.ruleCount())
 		}
+		return nil, err
+	})
+	return err
+}
+
+// staleness returns the duration since the last successful update, it's since
+// the cached rules were saved if no update succeeded yet, and zero if there
+// are no rules at all.
+func (s *gfwlistProvider) staleness() time.Duration {
+	s.mu.RLock()
+	lastSuccess := s.lastSuccess
+	s.mu.RUnlock()
+	if lastSuccess.IsZero() {
+		lastSuccess = s.loadRules().updatedAt
 	}
-	update()
+	if lastSuccess.IsZero() {
+		return 0
+	}
+	return time.Since(lastSuccess)
+}
+
+// staleThreshold is the staleness beyond which the failures are escalated,
+// it's three update intervals, or three gaps between the next cron runs if the
+// cron is set.
+func (s *gfwlistProvider) staleThreshold() time.Duration {
+	if s.schedule != nil {
+		next := s.schedule.Next(time.Now())
+		return 3 * s.schedule.Next(next).Sub(next)
+	}
+	interval := s.interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	return 3 * interval
+}
+
+func (s *gfwlistProvider) loop(ctx context.Context) {
+	s.Refresh(ctx)
 	interval := s.interval
 	if interval <= 0 {
 		interval = defaultInterval
 	}
-	timer := time.NewTimer(interval)
+	next := s.nextDelay(interval)
+	timer := time.NewTimer(next)
 	defer timer.Stop()
-	for range timer.C {
-		update()
-		timer.Reset(interval)
+	s.setNextUpdate(time.Now().Add(next))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			s.Refresh(ctx)
+			next = s.nextDelay(interval)
+			timer.Reset(next)
+			s.setNextUpdate(time.Now().Add(next))
+		}
 	}
 }
 
-func (s *gfwlistProvider) download() (io.ReadCloser, error) {
-	// TODO: support download with proxy
-	resp, err := http.Get(gfwlistDownloadURL)
+// nextDelay returns the delay until the next update, it follows the cron
+// schedule if it's configured, otherwise it's the jittered interval.
+func (s *gfwlistProvider) nextDelay(interval time.Duration) time.Duration {
+	if s.schedule != nil {
+		now := time.Now()
+		return s.schedule.Next(now).Sub(now)
+	}
+	return s.jitter(interval)
+}
+
+// maxJitterRatio caps the jitter ratio so the randomized interval is at least
+// a tenth of the interval and never refreshes in a tight loop.
+const maxJitterRatio = 0.9
+
+// jitter randomizes the interval by the jitter ratio, so the instances don't
+// download from the upstream at the same time.
+func (s *gfwlistProvider) jitter(interval time.Duration) time.Duration {
+	if s.jitterRatio <= 0 {
+		return interval
+	}
+	ratio := math.Min(s.jitterRatio, maxJitterRatio)
+	delta := (rand.Float64()*2 - 1) * ratio * float64(interval)
+	return interval + time.Duration(delta)
+}
+
+func (s *gfwlistProvider) setNextUpdate(next time.Time) {
+	s.mu.Lock()
+	s.nextUpdate = next
+	s.mu.Unlock()
+}
+
+func (s *gfwlistProvider) Status() ProviderStatus {
+	rules := s.loadRules()
+	stale := s.staleness()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	status := ProviderStatus{
+		NextUpdate:   s.nextUpdate,
+		StaleSeconds: int64(stale.Seconds()),
+		Rules: map[string]int{
+			"domain":  len(rules.proxyList.domains),
+			"ip":      len(rules.proxyList.ips),
+			"keyword": len(rules.proxyList.keywords),
+			"regex":   len(rules.proxyList.regexes),
+			"exact":   len(rules.proxyList.exacts),
+			"direct":  rules.directList.count(),
+		},
+		Parse: map[string]int{
+			"total":     s.stats.total,
+			"domain":    s.stats.domains,
+			"ip":        s.stats.ips,
+			"keyword":   s.stats.keywords,
+			"regex":     s.stats.regexes,
+			"exact":     s.stats.exacts,
+			"allowlist": s.stats.allowlist,
+			"comment":   s.stats.comments,
+			"skipped":   s.stats.skipped,
+			"reserved":  s.stats.reserved,
+			"invalid":   s.stats.invalid,
+		},
+	}
+	if !rules.updatedAt.IsZero() {
+		updatedAt := rules.updatedAt
+		status.UpdatedAt = &updatedAt
+	}
+	if s.lastError != nil {
+		status.LastError = s.lastError.Error()
+	}
+	status.ConsecutiveFailures = s.failures
+	return status
+}
+
+// newHTTPClient returns the client used to download gfwlist, the configured
+// proxy is preferred and falls back to the proxy from environment.
+func (s *gfwlistProvider) newHTTPClient() *http.Client {
+	timeout := s.timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if s.proxy != "" {
+		if err := s.setProxy(transport); err != nil {
+			s.logger.Warn("parse proxy failed, fallback to environment proxy", "proxy", s.proxy, "error", err)
+		}
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+// setProxy sets the configured proxy to the transport, the socks5 proxy dials
+// through the x/net/proxy dialer which honors the user and password in the
+// url, the others are used as the http proxy.
+func (s *gfwlistProvider) setProxy(transport *http.Transport) error {
+	u, err := url.Parse(s.proxy)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		transport.Proxy = http.ProxyURL(u)
+		return nil
+	}
+	dialer, err := proxy.FromURL(u, &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second})
+	if err != nil {
+		return err
+	}
+	contextDialer, ok := dialer.(proxy.ContextDialer)
+	if !ok {
+		return fmt.Errorf("socks5 dialer doesn't support context")
+	}
+	transport.Proxy = nil
+	transport.DialContext = contextDialer.DialContext
+	return nil
+}
+
+// gfwlistBody is the downloaded gfwlist with the validators of the response.
+type gfwlistBody struct {
+	io.ReadCloser
+	etag         string
+	lastModified string
+}
+
+// download downloads gfwlist and retries with exponential backoff on failure.
+func (s *gfwlistProvider) download(ctx context.Context) (*gfwlistBody, error) {
+	if s.file != "" {
+		body, err := s.openFile()
+		return s.limitBody(body), err
+	}
+	attempts := s.retryAttempts
+	if attempts <= 0 {
+		attempts = defaultRetryAttempts
+	}
+	delay := s.retryDelay
+	if delay <= 0 {
+		delay = defaultRetryDelay
+	}
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			s.logger.Warn("download gfwlist failed, retry later", "event", "download_retry", "attempt", i, "delay", delay, "error", err)
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			case <-timer.C:
+			}
+			delay *= 2
+		}
+		var body *gfwlistBody
+		body, err = s.downloadOnce(ctx)
+		if err == nil || errors.Is(err, errNotModified) {
+			return s.limitBody(body), err
+		}
+	}
+	return nil, err
+}
+
+// limitBody limits the size of the body so a broken mirror can't exhaust the
+// memory, it's applied after decompression.
+func (s *gfwlistProvider) limitBody(body *gfwlistBody) *gfwlistBody {
+	if body == nil {
+		return nil
+	}
+	maxSize := s.maxSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxSize
+	}
+	body.ReadCloser = &limitedReadCloser{ReadCloser: body.ReadCloser, limit: maxSize, remaining: maxSize}
+	return body
+}
+
+// limitedReadCloser fails the read once more than limit bytes are read.
+type limitedReadCloser struct {
+	io.ReadCloser
+	limit     int64
+	remaining int64
+}
+
+func (r *limitedReadCloser) Read(p []byte) (int, error) {
+	// read one more byte to tell whether the limit is exceeded
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if int64(n) > r.remaining {
+		n, r.remaining = int(r.remaining), 0
+		return n, fmt.Errorf("gfwlist exceeds the max size of %d bytes", r.limit)
+	}
+	r.remaining -= int64(n)
+	return n, err
+}
+
+func (s *gfwlistProvider) downloadOnce(ctx context.Context) (*gfwlistBody, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	if s.etag != "" {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+	if s.lastModified != "" {
+		req.Header.Set("If-Modified-Since", s.lastModified)
+	}
+	resp, err := s.client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("%w", err)
 	}
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		return nil, errNotModified
+	}
 	if resp.StatusCode != http.StatusOK {
 		defer resp.Body.Close()
 		body, _ := ioutil.ReadAll(resp.Body)
 		return nil, fmt.Errorf("download gfwlist failed, code: %d, body: %s", resp.StatusCode, body)
 	}
-	return resp.Body, nil
+	// the transport decompresses the body only if it requested gzip itself,
+	// some mirrors serve the gfwlist as a gzip file instead, which may be
+	// decompressed already, so the magic bytes are checked instead of the
+	// Content-Encoding or the suffix of the url.
+	body, err := gunzipIfCompressed(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("decompress gfwlist failed, %w", err)
+	}
+	return &gfwlistBody{
+		ReadCloser:   body,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// openFile opens the local gfwlist file, the modification time of the file is
+// used as the validator so an unchanged file is not parsed again.
+func (s *gfwlistProvider) openFile() (*gfwlistBody, error) {
+	f, err := os.Open(s.file)
+	if err != nil {
+		return nil, fmt.Errorf("open gfwlist file failed, %w", err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("stat gfwlist file failed, %w", err)
+	}
+	lastModified := stat.ModTime().UTC().Format(time.RFC3339Nano)
+	if s.lastModified == lastModified {
+		f.Close()
+		return nil, errNotModified
+	}
+	var rc io.ReadCloser = f
+	if strings.HasSuffix(s.file, ".gz") {
+		if rc, err = newGzipReadCloser(f); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("decompress gfwlist file failed, %w", err)
+		}
+	}
+	return &gfwlistBody{
+		ReadCloser:   rc,
+		lastModified: lastModified,
+	}, nil
+}
+
+// gzipReadCloser decompresses the underlying reader and closes both of them.
+type gzipReadCloser struct {
+	*gzip.Reader
+	rc io.ReadCloser
+}
+
+func newGzipReadCloser(rc io.ReadCloser) (*gzipReadCloser, error) {
+	gr, err := gzip.NewReader(rc)
+	if err != nil {
+		return nil, err
+	}
+	return &gzipReadCloser{Reader: gr, rc: rc}, nil
+}
+
+func (g *gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.rc.Close()
+}
+
+// gzipMagic is the header of the gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// gunzipIfCompressed decompresses rc if it starts with the gzip magic bytes,
+// otherwise it's returned as is.
+func gunzipIfCompressed(rc io.ReadCloser) (io.ReadCloser, error) {
+	br := bufio.NewReader(rc)
+	header, _ := br.Peek(len(gzipMagic))
+	body := struct {
+		io.Reader
+		io.Closer
+	}{br, rc}
+	if !bytes.Equal(header, gzipMagic) {
+		return body, nil
+	}
+	return newGzipReadCloser(body)
 }
 
 func tryGetDomainOrIP(v string) (t, string) {
 	return tryGetDomain(v, false)
 }
 
+// tryGetDomain returns an empty domain for the malformed url or hostname, so the
+// callers drop it by isValidDomain and count it as invalid.
 func tryGetDomain(v string, full bool) (_ t, vv string) {
 	defer func() {
 		vv = strings.Trim(vv, "*")
 	}()
-	if !strings.HasPrefix(v, "http://") {
-		v = "http://" + v
-	}
+	// the port and userinfo are removed by url.Hostname
+	v = "http://" + stripScheme(v)
 	v, _ = url.QueryUnescape(v)
 	parse, err := url.Parse(v)
 	if err != nil {
-		log.Printf("parse %s as url failed, %s", v, err)
-		return 0, ""
+		return domain, ""
 	}
 	if isIP(parse.Hostname()) {
 		return ip, parse.Hostname()
 	}
+	// convert the internationalized domain to punycode which dns actually uses
+	hostname, err := idna.ToASCII(parse.Hostname())
+	if err != nil {
+		return domain, ""
+	}
+	hostname = trimWildcard(hostname)
+	if isICANNSuffix(hostname) {
+		// the rule of a public suffix like co.uk routes the whole tld
+		return unknown, ""
+	}
 	if full {
-		return domain, parse.Hostname()
+		return domain, hostname
+	}
+	registrable, err := publicsuffix.EffectiveTLDPlusOne(hostname)
+	if err != nil {
+		// the ICANN public suffixes are dropped above, so the hostname is
+		// a single label like localhost which is dropped by isValidDomain,
+		// a private suffix like blogspot.com which is kept as is, or
+		// malformed. No label is indexed so any number of labels is safe.
+		return domain, hostname
 	}
-	pairs := strings.Split(parse.Hostname(), ".")
-	return domain, strings.Join(pairs[len(pairs)-2:], ".")
+	return domain, registrable
+}
+
+// trimWildcard removes the wildcard label of the hostname like *.example.com
+// and then the remaining *, the leading dot left would fail the eTLD+1 lookup.
+func trimWildcard(hostname string) string {
+	return strings.Trim(strings.TrimPrefix(hostname, "*."), "*")
+}
+
+// isICANNSuffix reports whether the hostname is a public suffix managed by
+// ICANN itself, e.g. com or co.uk, rather than a registrable domain.
+func isICANNSuffix(hostname string) bool {
+	suffix, icann := publicsuffix.PublicSuffix(hostname)
+	return icann && suffix == hostname
+}
+
+// stripScheme removes the http or https scheme of v exactly once.
+func stripScheme(v string) string {
+	for _, scheme := range []string{"http://", "https://"} {
+		if strings.HasPrefix(v, scheme) {
+			return strings.TrimPrefix(v, scheme)
+		}
+	}
+	return v
 }
 
 func isIP(v string) bool {
 	return net.ParseIP(v) != nil
 }
 
+// isValidDomain reports whether v is a well-formed domain with at least two
+// labels, clash rejects the whole ruleset if any rule is malformed.
+func isValidDomain(v string) bool {
+	if !strings.Contains(v, ".") || strings.HasPrefix(v, ".") || strings.HasSuffix(v, ".") || strings.Contains(v, "..") {
+		return false
+	}
+	for _, c := range v {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isReservedIP reports whether the ip or the network of the cidr is private,
+// loopback, link-local, multicast or unspecified, which should never be
+// proxied.
+func isReservedIP(v string) bool {
+	ip := net.ParseIP(v)
+	if _, n, err := net.ParseCIDR(v); err == nil {
+		ip = n.IP
+	}
+	if ip == nil {
+		return false
+	}
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified()
+}
+
+// toCIDR converts a bare ip or a cidr to cidr notation, bare ip uses a /32 or
+// /128 mask, it also reports whether it's an ipv6 address.
+func toCIDR(v string) (string, bool) {
+	if _, n, err := net.ParseCIDR(v); err == nil {
+		return n.String(), n.IP.To4() == nil
+	}
+	ip := net.ParseIP(v)
+	if ip != nil && ip.To4() == nil {
+		return v + "/128", true
+	}
+	return v + "/32", false
+}
+
+// parseRegex parses the /regex/ line, the regex containing "," is skipped
+// since it can't be represented in a clash rule.
+func (s *gfwlistProvider) parseRegex(line string) (t, string) {
+	if !s.domainRegex || len(line) <= 2 || !strings.HasSuffix(line, "/") {
+		return unknown, ""
+	}
+	regex := line[1 : len(line)-1]
+	if strings.Contains(regex, ",") {
+		return unknown, ""
+	}
+	return domainRegex, regex
+}
+
 func (s *gfwlistProvider) parseLine(line string) (t, string) {
-	if strings.HasPrefix(line, "|") {
-		line = strings.TrimLeft(line, "|")
-		line = strings.TrimLeft(line, "http://")
-		return tryGetDomain(line, true)
-	} else if strings.HasPrefix(line, "||") || strings.HasPrefix(line, "http://") {
-		line = strings.TrimLeft(line, "|")
-		line = strings.TrimLeft(line, "http://")
-		line = strings.TrimLeft(line, "https://")
+	if strings.HasPrefix(line, "/") {
+		return s.parseRegex(line)
+	}
+	if _, n, err := net.ParseCIDR(line); err == nil {
+		return ip, n.String()
+	}
+	// || must be checked before | since it's also prefixed with |
+	if strings.HasPrefix(line, "||") || strings.HasPrefix(line, "http://") {
+		line = stripScheme(strings.TrimPrefix(line, "||"))
 		return tryGetDomainOrIP(line)
+	} else if strings.HasPrefix(line, "|") {
+		line = stripScheme(strings.TrimPrefix(line, "|"))
+		typ, v := tryGetDomain(line, true)
+		// the wildcard label like *.example.com matches the subdomains
+		if host, _, _ := strings.Cut(line, "/"); typ == domain && !strings.HasPrefix(host, "*.") {
+			return domainExact, v
+		}
+		return typ, v
 	} else if strings.HasPrefix(line, ".") {
-		line = strings.TrimLeft(line, ".")
-		typ, v := tryGetDomainOrIP(line)
-		if strings.HasSuffix(v, "*") {
-			return domainKeyword, strings.Split(v, ".")[0]
-		} else {
-			return typ, v
+		line = strings.TrimPrefix(line, ".")
+		// the trailing * of the hostname must be checked before tryGetDomainOrIP
+		// which trims it, the * of the path is a wildcard of the url instead
+		host, _, _ := strings.Cut(line, "/")
+		if strings.HasSuffix(host, "*") {
+			if keyword := strings.Trim(strings.Split(host, ".")[0], "*"); keyword != "" {
+				return domainKeyword, keyword
+			}
+			return unknown, ""
 		}
+		return tryGetDomainOrIP(line)
 	} else if strings.Contains(line, ".") {
 		// try as url
 		return tryGetDomain(line, true)
@@ -191,38 +1095,463 @@ func (s *gfwlistProvider) parseLine(line string) (t, string) {
 	return unknown, ""
 }
 
+// parseStats counts the lines of gfwlist by how they are parsed.
+type parseStats struct {
+	total     int
+	domains   int
+	ips       int
+	keywords  int
+	regexes   int
+	exacts    int
+	allowlist int
+	comments  int
+	skipped   int
+	// reserved counts the private and reserved ips which are dropped.
+	reserved int
+	// invalid counts the malformed domains which are dropped.
+	invalid int
+
+	// the rules changed by the options after the source is parsed.
+	forced     int
+	excluded   int
+	suppressed []string
+	collapsed  int
+	deduped    int
+}
+
+func (st *parseStats) add(typ t) {
+	switch typ {
+	case ip:
+		st.ips++
+	case domain:
+		st.domains++
+	case domainKeyword:
+		st.keywords++
+	case domainRegex:
+		st.regexes++
+	case domainExact:
+		st.exacts++
+	default:
+		st.skipped++
+	}
+}
+
+// isBase64 reports whether b looks like base64 encoded, some mirrors serve the
+// decoded gfwlist which starts with [AutoProxy x.x.x] and contains dots.
+func isBase64(b []byte) bool {
+	if len(bytes.TrimSpace(b)) == 0 {
+		return false
+	}
+	for _, c := range b {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9':
+		case c == '+', c == '/', c == '=', c == '\r', c == '\n':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 /**
-parseToList parse the raw gfwlist to domain and ip list.
+parseToList parse the raw gfwlist to the proxy list and the direct list,
+the direct list is parsed from the @@ allowlist. The decoded gfwlist is
+written to decoded if it's not nil.
 */
-func (s *gfwlistProvider) parseToList(rc io.ReadCloser) (domainList []string, ipList []string, domainKeywordList []string, _ error) {
+func (s *gfwlistProvider) parseToList(rc io.ReadCloser, decoded io.Writer) (proxyList ruleList, directList ruleList, stats parseStats, _ error) {
 	defer rc.Close()
-	scanner := bufio.NewScanner(base64.NewDecoder(base64.StdEncoding, rc))
+	var r io.Reader = bufio.NewReader(rc)
+	if head, _ := r.(*bufio.Reader).Peek(512); isBase64(head) {
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	}
+	if decoded != nil {
+		r = io.TeeReader(r, decoded)
+	}
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		line := scanner.Text()
 		if line == "" {
 			continue
 		}
+		stats.total++
+		if strings.HasPrefix(line, "@@") {
+			typ, v := s.parseLine(strings.TrimPrefix(line, "@@"))
+			if isDomain(typ) && !isValidDomain(v) {
+				stats.invalid++
+				continue
+			}
+			if typ == unknown {
+				stats.skipped++
+			} else {
+				stats.allowlist++
+			}
+			directList.add(typ, v)
+			continue
+		}
 		switch line[0] {
-		case '!', '[', '/', '@':
-			// skip comment, regex, allowList,
+		case '!', '[', '@':
+			// skip comment
+			stats.comments++
 			continue
 		}
 
 		typ, v := s.parseLine(line)
-		switch typ {
-		case ip:
-			ipList = append(ipList, v)
-		case domain:
-			domainList = append(domainList, v)
-		case domainKeyword:
-			domainKeywordList = append(domainKeywordList, v)
+		if typ == ip && isReservedIP(v) {
+			stats.reserved++
+			continue
+		}
+		if isDomain(typ) && !isValidDomain(v) {
+			stats.invalid++
+			continue
 		}
+		stats.add(typ)
+		proxyList.add(typ, v)
+	}
+	proxyList.normalize()
+	directList.normalize()
+	return proxyList, directList, stats, scanner.Err()
+}
+
+// Rules is the parsed rules exported for the library users.
+type Rules struct {
+	// Domains are matched as suffixes.
+	Domains []string
+	// ExactDomains are matched exactly.
+	ExactDomains []string
+	// IPs are the ips or cidrs.
+	IPs      []string
+	Keywords []string
+	Regexes  []string
+}
+
+func newRules(list ruleList) Rules {
+	return Rules{
+		Domains:      list.domains,
+		ExactDomains: list.exacts,
+		IPs:          list.ips,
+		Keywords:     list.keywords,
+		Regexes:      list.regexes,
+	}
+}
+
+// ParseGFWList parses gfwlist from r, either base64 encoded or plain, with the
+// same options of the provider, e.g. WithDomainRegex or WithCustomRules. The
+// proxy rules are parsed from the normal lines and the direct rules from the
+// @@ allowlist, both are deduplicated and sorted.
+func ParseGFWList(r io.Reader, opts ...Option) (proxyRules, directRules Rules, err error) {
+	s := newGfwlistProvider(append([]Option{WithCacheFile("")}, opts...)...)
+	proxyList, directList, err := s.parse(ioutil.NopCloser(r))
+	if err != nil {
+		return Rules{}, Rules{}, err
+	}
+	return newRules(proxyList), newRules(directList), nil
+}
+
+// Option configures the gfwlist provider.
+type Option func(*gfwlistProvider)
+
+// WithName sets the name of the provider, which is served on
+// /clash/provider/<name>, defaults to gfwlist.
+func WithName(name string) Option {
+	return func(s *gfwlistProvider) {
+		s.name = name
+	}
+}
+
+// WithURL sets the url to download gfwlist from, it's useful to use a mirror
+// when the default one is unreachable.
+func WithURL(url string) Option {
+	return func(s *gfwlistProvider) {
+		s.url = url
+	}
+}
+
+// WithInterval sets the interval to update gfwlist, defaults to one hour.
+func WithInterval(interval time.Duration) Option {
+	return func(s *gfwlistProvider) {
+		s.interval = interval
+	}
+}
+
+// WithFile reads gfwlist from the local file instead of downloading it,
+// the file is read on each update so changes are picked up.
+func WithFile(file string) Option {
+	return func(s *gfwlistProvider) {
+		s.file = file
+	}
+}
+
+// WithFormat sets the default output format used when the format query is
+// absent, defaults to clash.
+func WithFormat(format string) Option {
+	return func(s *gfwlistProvider) {
+		s.format = format
 	}
-	return uniqueList(domainList), uniqueList(ipList), domainKeywordList, scanner.Err()
 }
 
-func newGfwlistProvider() *gfwlistProvider {
-	s := &gfwlistProvider{}
-	go s.start()
+// WithFinalRule appends the catch-all MATCH rule with the policy, e.g. DIRECT,
+// after the classical clash rules.
+func WithFinalRule(policy string) Option {
+	return func(s *gfwlistProvider) {
+		s.finalPolicy = policy
+	}
+}
+
+// WithCacheControl sets the Cache-Control of the rules, e.g. max-age=3600,
+// defaults to no-cache. auto lets the clients cache the rules until the next
+// update.
+func WithCacheControl(cacheControl string) Option {
+	return func(s *gfwlistProvider) {
+		s.cacheControl = cacheControl
+	}
+}
+
+// WithRawEndpoint serves the decoded gfwlist on /clash/provider/<name>/raw,
+// which helps to find out how a line is parsed.
+func WithRawEndpoint(enable bool) Option {
+	return func(s *gfwlistProvider) {
+		s.serveRaw = enable
+	}
+}
+
+// WithDomainRegex translates the regex lines of gfwlist to DOMAIN-REGEX rules
+// instead of skipping them, it's only supported by clash-meta.
+func WithDomainRegex(enable bool) Option {
+	return func(s *gfwlistProvider) {
+		s.domainRegex = enable
+	}
+}
+
+// WithNoResolve sets whether the ip rules are appended with no-resolve when
+// the no_resolve query is absent, defaults to true.
+func WithNoResolve(enable bool) Option {
+	return func(s *gfwlistProvider) {
+		s.noResolve = enable
+	}
+}
+
+// withParser parses the source with the parser instead of parseToList, it's
+// used by the providers of other sources.
+func withParser(parser func(rc io.ReadCloser, decoded io.Writer) (ruleList, ruleList, parseStats, error)) Option {
+	return func(s *gfwlistProvider) {
+		s.parseSource = parser
+	}
+}
+
+// WithCustomRules merges the rules into the proxy rules, the rules use the
+// same syntax as gfwlist lines, e.g. example.com or 1.2.3.0/24.
+func WithCustomRules(rules ...string) Option {
+	return func(s *gfwlistProvider) {
+		s.customRules = append(s.customRules, rules...)
+	}
+}
+
+// WithCustomRulesFile merges the rules in the file, one per line, into the
+// proxy rules. The file is read on each update so changes are picked up, even
+// if the source is not modified.
+func WithCustomRulesFile(file string) Option {
+	return func(s *gfwlistProvider) {
+		s.customRulesFile = file
+	}
+}
+
+// WithExcludeDomains removes the domains and their subdomains from the proxy
+// rules, e.g. a cdn accessed directly.
+func WithExcludeDomains(domains ...string) Option {
+	return func(s *gfwlistProvider) {
+		for _, domain := range domains {
+			s.excludes = append(s.excludes, strings.ToLower(strings.Trim(domain, ".")))
+		}
+	}
+}
+
+// WithForceSuffixes renders the domains as DOMAIN-SUFFIX rules instead of the
+// exact domains or the keywords the parser yields for them, e.g.
+// googlevideo.com, the domains absent in gfwlist are not added.
+func WithForceSuffixes(domains ...string) Option {
+	return func(s *gfwlistProvider) {
+		for _, domain := range domains {
+			s.forcedSuffixes = append(s.forcedSuffixes, strings.ToLower(strings.Trim(domain, "*.")))
+		}
+	}
+}
+
+// WithKeywordDenylist removes the keywords from the proxy rules, e.g. google
+// which matches far more than intended.
+func WithKeywordDenylist(keywords ...string) Option {
+	return func(s *gfwlistProvider) {
+		if s.keywordDenylist == nil {
+			s.keywordDenylist = make(map[string]bool, len(keywords))
+		}
+		for _, keyword := range keywords {
+			s.keywordDenylist[strings.ToLower(keyword)] = true
+		}
+	}
+}
+
+// WithMinKeywordLength removes the keywords shorter than n from the proxy
+// rules since the short keywords are dangerously broad.
+func WithMinKeywordLength(n int) Option {
+	return func(s *gfwlistProvider) {
+		s.minKeywordLength = n
+	}
+}
+
+// WithCollapseSubdomains removes the suffixes whose parent suffix is also in
+// the rules, e.g. sub.example.com is removed if example.com is present since
+// the latter matches it anyway, which shrinks the rules.
+func WithCollapseSubdomains() Option {
+	return func(s *gfwlistProvider) {
+		s.collapseSubdomains = true
+	}
+}
+
+// WithCacheFile sets the file to persist the last successfully parsed gfwlist,
+// which is loaded on startup so the rules are served before the first update.
+// The cache is disabled when file is empty.
+func WithCacheFile(file string) Option {
+	return func(s *gfwlistProvider) {
+		s.cacheFile = file
+		s.cacheFileSet = true
+	}
+}
+
+// WithLogger sets the logger of the provider and the server, defaults to
+// slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *gfwlistProvider) {
+		s.rootLogger = logger
+	}
+}
+
+// WithCron schedules the updates with the standard cron spec instead of the
+// interval, e.g. "0 4 * * *" to update at 4am daily.
+func WithCron(spec string) Option {
+	return func(s *gfwlistProvider) {
+		s.cron = spec
+	}
+}
+
+// WithJitter randomizes each update interval by up to the ratio of it in
+// either direction, e.g. 0.1 for ±10%, the ratio is capped at 0.9.
+func WithJitter(ratio float64) Option {
+	return func(s *gfwlistProvider) {
+		s.jitterRatio = ratio
+	}
+}
+
+// WithRetry sets the max attempts to download gfwlist and the delay before
+// the first retry, the delay doubles on each retry.
+func WithRetry(attempts int, delay time.Duration) Option {
+	return func(s *gfwlistProvider) {
+		s.retryAttempts = attempts
+		s.retryDelay = delay
+	}
+}
+
+// WithTimeout sets the timeout of each gfwlist download.
+func WithTimeout(timeout time.Duration) Option {
+	return func(s *gfwlistProvider) {
+		s.timeout = timeout
+	}
+}
+
+// WithHTTPClient sets the client to download gfwlist, the proxy and timeout
+// options are ignored when it's set.
+func WithHTTPClient(client *http.Client) Option {
+	return func(s *gfwlistProvider) {
+		s.client = client
+	}
+}
+
+// WithMaxSize sets the max size of the downloaded source in bytes, the update
+// fails if it's exceeded, defaults to 50MB.
+func WithMaxSize(size int64) Option {
+	return func(s *gfwlistProvider) {
+		s.maxSize = size
+	}
+}
+
+// WithProxy sets the http or socks5 proxy used to download gfwlist,
+// e.g. http://127.0.0.1:7890 or socks5://127.0.0.1:7891.
+func WithProxy(proxy string) Option {
+	return func(s *gfwlistProvider) {
+		s.proxy = proxy
+	}
+}
+
+// newGfwlistProvider creates the gfwlist provider with the options without any
+// side effect, Start should be called to start updating it.
+func newGfwlistProvider(opts ...Option) *gfwlistProvider {
+	s := &gfwlistProvider{
+		url:        gfwlistDownloadURL,
+		name:       defaultProviderName,
+		noResolve:  true,
+		rootLogger: slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if !s.cacheFileSet {
+		source := s.url
+		if s.file != "" {
+			source = s.file
+		}
+		s.cacheFile = defaultCacheFile(s.name, source)
+	}
+	s.logger = s.rootLogger.With("provider", s.name)
+	if s.parseSource == nil {
+		s.parseSource = s.parseToList
+	}
+	if s.cron != "" {
+		schedule, err := cron.ParseStandard(s.cron)
+		if err != nil {
+			s.logger.Error("parse cron failed, fall back to the interval", "cron", s.cron, "error", err)
+		}
+		s.schedule = schedule
+	}
+	if s.client == nil {
+		s.client = s.newHTTPClient()
+	}
 	return s
 }
+
+// updateContext detaches ctx from the cancellation of the caller and bounds it
+// by the update loop if the provider is started.
+func (s *gfwlistProvider) updateContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	s.mu.RLock()
+	loopCtx := s.loopCtx
+	s.mu.RUnlock()
+	if loopCtx == nil {
+		return ctx, cancel
+	}
+	stop := context.AfterFunc(loopCtx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// Start loads the cached rules and starts updating in the background until ctx
+// is done or Stop is called.
+func (s *gfwlistProvider) Start(ctx context.Context) {
+	if err := s.loadCache(); err != nil {
+		s.logger.Warn("load gfwlist cache failed", "event", "load_cache", "error", err)
+	}
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.mu.Lock()
+	s.loopCtx = ctx
+	s.mu.Unlock()
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		s.loop(ctx)
+	}()
+}
+
+// Stop stops updating and waits for the update loop to exit.
+func (s *gfwlistProvider) Stop() {
+	s.cancel()
+	<-s.done
+}
@@ -0,0 +1,141 @@
+package mate
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStripScheme(test *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"http://example.com", "example.com"},
+		{"https://example.com", "example.com"},
+		{"example.com", "example.com"},
+		{"thttp.com", "thttp.com"},
+		{"httpbin.org", "httpbin.org"},
+		{"https.example.com", "https.example.com"},
+		// the scheme is removed exactly once
+		{"http://https://example.com", "https://example.com"},
+	}
+	for _, tt := range tests {
+		if got := stripScheme(tt.in); got != tt.want {
+			test.Errorf("stripScheme(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseLine(test *testing.T) {
+	s := newGfwlistProvider(WithCacheFile(""))
+	tests := []struct {
+		line    string
+		wantTyp t
+		want    string
+	}{
+		// the domains starting with the characters of the prefixes
+		{"thttp.com", domain, "thttp.com"},
+		{"pttp.example.com", domain, "pttp.example.com"},
+		{"||thttp.com", domain, "thttp.com"},
+		{"||pttp.example.com", domain, "example.com"},
+		{"|thttp.com", domainExact, "thttp.com"},
+		{"|spttp.example.com", domainExact, "spttp.example.com"},
+		{".thttp.com", domain, "thttp.com"},
+		// || is checked before |
+		{"||example.com", domain, "example.com"},
+		{"|http://www.example.com", domainExact, "www.example.com"},
+		{"|https://www.example.com/path", domainExact, "www.example.com"},
+		{"||https://example.com", domain, "example.com"},
+		// the wildcard label is removed before the eTLD+1 lookup
+		{"||*.example.com", domain, "example.com"},
+		{"||*.www.example.co.uk", domain, "example.co.uk"},
+		{"||*.com", unknown, ""},
+		{"|https://*.example.com", domain, "example.com"},
+		{"*.example.com", domain, "example.com"},
+		{"http://www.example.com", domain, "example.com"},
+		{"https://www.example.com", domain, "www.example.com"},
+		{".google.*", domainKeyword, "google"},
+		{".*", unknown, ""},
+		// the * of the path is not a keyword
+		{".example.com/path*", domain, "example.com"},
+		{".www.example.com/*", domain, "example.com"},
+		{"1.2.3.0/24", ip, "1.2.3.0/24"},
+		{"||1.2.3.4", ip, "1.2.3.4"},
+		{"localhost", unknown, ""},
+		// the public suffixes are too broad
+		{"||co.uk", unknown, ""},
+		{".com.cn", unknown, ""},
+		{"co.uk", unknown, ""},
+		{"||example.co.uk", domain, "example.co.uk"},
+		{"||www.example.co.uk", domain, "example.co.uk"},
+		// the hostnames eTLD+1 can't be derived from
+		{"||localhost", domain, "localhost"},
+		{"||blogspot.com", domain, "blogspot.com"},
+		// the malformed urls are dropped as invalid domains
+		{"||exa mple.com", domain, ""},
+	}
+	for _, tt := range tests {
+		typ, v := s.parseLine(tt.line)
+		if typ != tt.wantTyp || v != tt.want {
+			test.Errorf("parseLine(%q) = %v, %q, want %v, %q", tt.line, typ, v, tt.wantTyp, tt.want)
+		}
+	}
+}
+
+func TestParseWildcardDomains(test *testing.T) {
+	src := "||*.example.com\n|https://*.example.org\n*.example.net\n"
+	proxyRules, _, err := ParseGFWList(strings.NewReader(src))
+	if err != nil {
+		test.Fatal(err)
+	}
+	want := []string{"example.com", "example.net", "example.org"}
+	if strings.Join(proxyRules.Domains, ",") != strings.Join(want, ",") {
+		test.Errorf("domains = %v, want %v", proxyRules.Domains, want)
+	}
+}
+
+func TestIsValidDomain(test *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"example.com", true},
+		{"blogspot.com", true},
+		{"localhost", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isValidDomain(tt.in); got != tt.want {
+			test.Errorf("isValidDomain(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestJitter(test *testing.T) {
+	const interval = time.Hour
+	for _, ratio := range []float64{0.1, 0.9, 1, 5} {
+		s := newGfwlistProvider(WithCacheFile(""), WithJitter(ratio))
+		for i := 0; i < 1000; i++ {
+			if d := s.jitter(interval); d < interval/10 || d > 2*interval {
+				test.Fatalf("jitter(%s) with ratio %v = %s", interval, ratio, d)
+			}
+		}
+	}
+}
+
+func TestStaleThreshold(test *testing.T) {
+	tests := []struct {
+		opts []Option
+		want time.Duration
+	}{
+		{[]Option{WithInterval(time.Hour)}, 3 * time.Hour},
+		{[]Option{WithInterval(time.Hour), WithCron("CRON_TZ=UTC 0 4 * * *")}, 72 * time.Hour},
+		{[]Option{WithCron("*/10 * * * *")}, 30 * time.Minute},
+	}
+	for i, tt := range tests {
+		s := newGfwlistProvider(append([]Option{WithCacheFile("")}, tt.opts...)...)
+		if got := s.staleThreshold(); got != tt.want {
+			test.Errorf("#%d staleThreshold() = %s, want %s", i, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package mate
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	updatesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "clash_mate",
+		Name:      "updates_total",
+		Help:      "Total number of provider updates by result.",
+	}, []string{"provider", "result"})
+
+	lastSuccessTimestamp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "clash_mate",
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Unix timestamp of the last successful provider update.",
+	}, []string{"provider"})
+
+	rulesCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "clash_mate",
+		Name:      "rules",
+		Help:      "Number of the current rules by type.",
+	}, []string{"provider", "type"})
+
+	parseLines = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "clash_mate",
+		Name:      "parse_lines",
+		Help:      "Number of the lines in the last parse by how they are parsed.",
+	}, []string{"provider", "type"})
+
+	updateDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "clash_mate",
+		Name:      "update_duration_seconds",
+		Help:      "Duration of provider updates.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 10),
+	}, []string{"provider"})
+
+	rejectedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "clash_mate",
+		Name:      "rejected_requests_total",
+		Help:      "Total number of the requests rejected over the concurrency limit.",
+	})
+)
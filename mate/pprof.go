@@ -0,0 +1,58 @@
+package mate
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+// EnablePprof serves the net/http/pprof handlers on /debug/pprof/ of addr in
+// the background, addr must be a loopback address like localhost:6060 or a
+// unix socket since the profiles expose the internals. They're not served on
+// the public listener so a reverse proxy on the same host can't expose them.
+func (s *Server) EnablePprof(addr string) error {
+	if err := checkLocalAddr(addr); err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	ln, err := listen(addr)
+	if err != nil {
+		return fmt.Errorf("listen pprof failed, %w", err)
+	}
+	// no write timeout since the cpu profile and the trace take a while
+	s.pprof = &http.Server{Handler: mux, ReadTimeout: defaultReadTimeout}
+	s.logger.Info("pprof listened", "event", "pprof", "addr", addr)
+	go func() {
+		if err := s.pprof.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("serve pprof failed", "event", "pprof", "error", err)
+		}
+	}()
+	return nil
+}
+
+// checkLocalAddr reports an error if addr is not a loopback address or a unix
+// socket.
+func checkLocalAddr(addr string) error {
+	if strings.HasPrefix(addr, unixScheme) {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid pprof addr: %s, %w", addr, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("invalid pprof addr: %s, it must be a loopback address", addr)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package mate
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Provider is a rule provider served by the server.
+type Provider interface {
+	// Name identifies the provider, it's served on /clash/provider/<name>.
+	Name() string
+	// Handle serves the rules.
+	Handle(wr http.ResponseWriter, r *http.Request)
+	// Ready reports whether the rules have been updated successfully at
+	// least once.
+	Ready() bool
+	// Refresh updates the rules on demand.
+	Refresh(ctx context.Context) error
+	// Start starts updating the rules in the background until ctx is done or
+	// Stop is called.
+	Start(ctx context.Context)
+	// Stop stops updating and waits for the update loop to exit.
+	Stop()
+	// Status reports the status of the provider.
+	Status() ProviderStatus
+}
+
+// ProviderStatus is the status of a provider.
+type ProviderStatus struct {
+	// UpdatedAt is the time of the last successful update, nil if the
+	// provider has never been updated.
+	UpdatedAt *time.Time `json:"updated_at"`
+	// LastError is the error of the last update, empty if it succeeded.
+	LastError  string    `json:"last_error,omitempty"`
+	NextUpdate time.Time `json:"next_update"`
+	// ConsecutiveFailures counts the failed updates since the last success.
+	ConsecutiveFailures int `json:"consecutive_failures"`
+	// StaleSeconds is the seconds since the last successful update, the
+	// rules are served from the cache or an old update when it grows.
+	StaleSeconds int64 `json:"stale_seconds"`
+	// Rules counts the current rules by type.
+	Rules map[string]int `json:"rules"`
+	// Parse counts the lines in the last parse by how they are parsed.
+	Parse map[string]int `json:"parse,omitempty"`
+}
+
+// directProvider is implemented by the providers which also serve the rules
+// should be routed directly, on /clash/provider/<name>-direct.
+type directProvider interface {
+	HandleDirect(wr http.ResponseWriter, r *http.Request)
+}
+
+// rawProvider is implemented by the providers which serve the decoded source
+// for troubleshooting, on /clash/provider/<name>/raw.
+type rawProvider interface {
+	HandleRaw(wr http.ResponseWriter, r *http.Request)
+}
+
+// splitProvider is implemented by the providers which serve the ip rules and
+// the domain rules separately, on /clash/provider/<name>/ip and
+// /clash/provider/<name>/domain, for the ipcidr and domain behaviors.
+type splitProvider interface {
+	HandleIP(wr http.ResponseWriter, r *http.Request)
+	HandleDomain(wr http.ResponseWriter, r *http.Request)
+}
+
+var _ Provider = (*gfwlistProvider)(nil)
+var _ directProvider = (*gfwlistProvider)(nil)
+var _ rawProvider = (*gfwlistProvider)(nil)
+var _ splitProvider = (*gfwlistProvider)(nil)
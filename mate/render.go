@@ -0,0 +1,760 @@
+package mate
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v2"
+)
+
+// output formats of the rules.
+const (
+	formatClash       = "clash"
+	formatSurge       = "surge"
+	formatQuantumultX = "quantumultx"
+	formatSingBox     = "sing-box"
+	formatDnsmasq     = "dnsmasq"
+	formatDomains     = "domains"
+	formatLoon        = "loon"
+	formatHosts       = "hosts"
+)
+
+const (
+	defaultQuantumultXPolicy = "proxy"
+	defaultLoonPolicy        = "Proxy"
+	defaultHostsSink         = "0.0.0.0"
+)
+
+// formatter renders the rules in a format with the query, marshal returns the
+// number of the rendered rules too since each format skips what it can't
+// represent.
+type formatter struct {
+	contentType string
+	marshal     func(s *gfwlistProvider, list ruleList, query url.Values) ([]byte, int, error)
+}
+
+// formatters are the supported output formats, which are selected by the
+// format query.
+var formatters = map[string]formatter{
+	formatClash: {
+		contentType: "application/yaml",
+		marshal:     (*gfwlistProvider).marshalClash,
+	},
+	formatSurge: {
+		contentType: "text/plain; charset=utf-8",
+		marshal: func(s *gfwlistProvider, list ruleList, query url.Values) ([]byte, int, error) {
+			noResolve, err := s.noResolveOf(query)
+			if err != nil {
+				return nil, 0, err
+			}
+			b, n := s.marshalSurge(list, noResolve)
+			return b, n, nil
+		},
+	},
+	formatQuantumultX: {
+		contentType: "text/plain; charset=utf-8",
+		marshal: func(s *gfwlistProvider, list ruleList, query url.Values) ([]byte, int, error) {
+			policy, err := policyOf(query)
+			if err != nil {
+				return nil, 0, err
+			}
+			b, n := s.marshalQuantumultX(list, policy)
+			return b, n, nil
+		},
+	},
+	formatSingBox: {
+		contentType: "application/json",
+		marshal: func(s *gfwlistProvider, list ruleList, query url.Values) ([]byte, int, error) {
+			return s.marshalSingBox(list)
+		},
+	},
+	formatDnsmasq: {
+		contentType: "text/plain; charset=utf-8",
+		marshal: func(s *gfwlistProvider, list ruleList, query url.Values) ([]byte, int, error) {
+			return s.marshalDnsmasq(list, query.Get("dns"))
+		},
+	},
+	formatDomains: {
+		contentType: "text/plain; charset=utf-8",
+		marshal: func(s *gfwlistProvider, list ruleList, query url.Values) ([]byte, int, error) {
+			b, n := s.marshalDomains(list)
+			return b, n, nil
+		},
+	},
+	formatLoon: {
+		contentType: "text/plain; charset=utf-8",
+		marshal: func(s *gfwlistProvider, list ruleList, query url.Values) ([]byte, int, error) {
+			noResolve, err := s.noResolveOf(query)
+			if err != nil {
+				return nil, 0, err
+			}
+			policy, err := policyOf(query)
+			if err != nil {
+				return nil, 0, err
+			}
+			b, n := s.marshalLoon(list, policy, noResolve)
+			return b, n, nil
+		},
+	},
+	formatHosts: {
+		contentType: "text/plain; charset=utf-8",
+		marshal: func(s *gfwlistProvider, list ruleList, query url.Values) ([]byte, int, error) {
+			return s.marshalHosts(list, query.Get("sink"))
+		},
+	},
+}
+
+// acceptFormats maps the media types of the Accept header to the formats.
+var acceptFormats = map[string]string{
+	"application/yaml": formatClash,
+	"application/json": formatSingBox,
+	"text/plain":       formatDomains,
+}
+
+// formatOfAccept returns the format of the first media type in the Accept
+// header which has a matched format, the wildcards are ignored so the client
+// without preference gets the default format.
+func formatOfAccept(accept string) string {
+	for _, mediaType := range strings.Split(accept, ",") {
+		mediaType = strings.TrimSpace(strings.Split(mediaType, ";")[0])
+		if format, ok := acceptFormats[strings.ToLower(mediaType)]; ok {
+			return format
+		}
+	}
+	return ""
+}
+
+func isFormat(format string) bool {
+	_, ok := formatters[format]
+	return ok
+}
+
+// behaviors of clash rule provider.
+const (
+	behaviorClassical = "classical"
+	behaviorDomain    = "domain"
+	behaviorIPCIDR    = "ipcidr"
+)
+
+// defaultRetryAfter is the Retry-After before any update finished, which is
+// roughly how long the first download and parse take.
+const defaultRetryAfter = 5 * time.Second
+
+// withDefaultQuery returns the request with the query param set to value if
+// it's absent.
+func withDefaultQuery(r *http.Request, key, value string) *http.Request {
+	query := r.URL.Query()
+	if query.Get(key) != "" {
+		return r
+	}
+	query.Set(key, value)
+	r = r.Clone(r.Context())
+	r.URL.RawQuery = query.Encode()
+	return r
+}
+
+// serveNotReady tells the client to retry later since the rules are not ready,
+// so the client won't cache the empty rules. The client is told to retry after
+// about the duration of the last update attempt.
+func (s *gfwlistProvider) serveNotReady(wr http.ResponseWriter) {
+	s.mu.RLock()
+	retryAfter := s.lastDuration
+	s.mu.RUnlock()
+	if retryAfter <= 0 {
+		retryAfter = defaultRetryAfter
+	}
+	wr.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(wr, "rules are not ready, retry later", http.StatusServiceUnavailable)
+}
+
+// notModified sets the ETag and Last-Modified headers and reports whether the
+// client's copy is still current, If-None-Match takes precedence over
+// If-Modified-Since.
+func notModified(wr http.ResponseWriter, r *http.Request, etag string, updatedAt time.Time) bool {
+	wr.Header().Set("ETag", etag)
+	wr.Header().Set("Last-Modified", updatedAt.UTC().Format(http.TimeFormat))
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, v := range strings.Split(match, ",") {
+			v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+			if v == etag || v == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	// Last-Modified has only second precision.
+	return !updatedAt.Truncate(time.Second).After(since)
+}
+
+func (s *gfwlistProvider) serve(wr http.ResponseWriter, r *http.Request, list ruleList, cache *renderCache, updatedAt time.Time) {
+	query := r.URL.Query()
+	// the 304 must carry the same Vary as the 200
+	wr.Header().Add("Vary", "Accept")
+	wr.Header().Add("Vary", "Accept-Encoding")
+	if query.Get("format") == "" {
+		if format := formatOfAccept(r.Header.Get("Accept")); format != "" {
+			query.Set("format", format)
+		}
+	}
+	out, err := cache.get(s, list, query, updatedAt)
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return
+	}
+	wr.Header().Set("Content-Type", out.contentType)
+	wr.Header().Set("Cache-Control", s.cacheControlValue())
+	wr.Header().Set("X-Rules-Stale-Seconds", strconv.FormatInt(int64(s.staleness().Seconds()), 10))
+	setRuleHeaders(wr, list, out, updatedAt)
+	if notModified(wr, r, out.etag, updatedAt) {
+		wr.WriteHeader(http.StatusNotModified)
+		return
+	}
+	b := out.body
+	if acceptGzip(r) {
+		wr.Header().Set("Content-Encoding", "gzip")
+		b = out.gzipped
+	}
+	wr.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	writeUnlessHead(wr, r, b)
+}
+
+// setRuleHeaders sets the count of the rendered rules, the counts of the served
+// rules by type, the format and the time the rules are generated, so the rules
+// can be monitored without parsing the body.
+func setRuleHeaders(wr http.ResponseWriter, list ruleList, out *rendered, updatedAt time.Time) {
+	wr.Header().Set("X-Rule-Count", strconv.Itoa(out.count))
+	wr.Header().Set("X-Rule-Domains", strconv.Itoa(len(list.domains)+len(list.exacts)))
+	wr.Header().Set("X-Rule-Ips", strconv.Itoa(len(list.ips)))
+	wr.Header().Set("X-Rule-Keywords", strconv.Itoa(len(list.keywords)))
+	wr.Header().Set("X-Rule-Format", out.format)
+	wr.Header().Set("X-Generated-At", updatedAt.UTC().Format(time.RFC3339))
+}
+
+// cacheControlAuto derives the max-age of Cache-Control from the next update.
+const cacheControlAuto = "auto"
+
+// cacheControlValue returns the Cache-Control of the rules, the auto value
+// lets the clients cache the rules until the next update so they refetch
+// right after the rules are refreshed.
+func (s *gfwlistProvider) cacheControlValue() string {
+	if s.cacheControl == "" {
+		return "no-cache"
+	}
+	if s.cacheControl != cacheControlAuto {
+		return s.cacheControl
+	}
+	s.mu.RLock()
+	next := s.nextUpdate
+	s.mu.RUnlock()
+	maxAge := int(time.Until(next).Seconds())
+	if maxAge <= 0 {
+		return "no-cache"
+	}
+	return fmt.Sprintf("max-age=%d", maxAge)
+}
+
+// maxRenderCacheSize limits the rendered outputs cached for a rule set, since
+// the policy and dns are arbitrary the outputs beyond it are not cached.
+const maxRenderCacheSize = 32
+
+// renderKey is the query params affecting the rendered output.
+type renderKey struct {
+	format    string
+	policy    string
+	behavior  string
+	dns       string
+	sink      string
+	noResolve string
+}
+
+// rendered is the rendered output with its gzip compressed copy.
+type rendered struct {
+	format string
+	// count is the number of the rendered rules.
+	count       int
+	contentType string
+	body        []byte
+	gzipped     []byte
+	etag        string
+}
+
+// renderCache caches the rendered outputs of a rule list, it belongs to a rule
+// set so it's invalidated once the rule set is swapped on update.
+type renderCache struct {
+	mu sync.Mutex
+	m  map[renderKey]*rendered
+}
+
+func (c *renderCache) get(s *gfwlistProvider, list ruleList, query url.Values, generatedAt time.Time) (*rendered, error) {
+	key := renderKey{
+		format:    query.Get("format"),
+		policy:    query.Get("policy"),
+		behavior:  query.Get("behavior"),
+		dns:       query.Get("dns"),
+		sink:      query.Get("sink"),
+		noResolve: query.Get("no_resolve"),
+	}
+	if key.format == "" {
+		key.format = s.format
+	}
+	if key.format == "" {
+		key.format = formatClash
+	}
+	c.mu.Lock()
+	out, ok := c.m[key]
+	c.mu.Unlock()
+	if ok {
+		return out, nil
+	}
+
+	contentType, b, count, err := s.render(list, query, generatedAt)
+	if err != nil {
+		return nil, err
+	}
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write(b)
+	gw.Close()
+	sum := sha256.Sum256(b)
+	out = &rendered{
+		format:      key.format,
+		count:       count,
+		contentType: contentType,
+		body:        b,
+		gzipped:     gzipped.Bytes(),
+		etag:        `"` + hex.EncodeToString(sum[:]) + `"`,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = make(map[renderKey]*rendered)
+	}
+	if len(c.m) < maxRenderCacheSize {
+		c.m[key] = out
+	}
+	return out, nil
+}
+
+// render renders the list in the format of the query, the default format is
+// used when the format query is absent. The clash output is prefixed with a
+// comment of when the rules are generated, which clash ignores.
+func (s *gfwlistProvider) render(list ruleList, query url.Values, generatedAt time.Time) (contentType string, b []byte, count int, err error) {
+	format := query.Get("format")
+	if format == "" {
+		format = s.format
+	}
+	if format == "" {
+		format = formatClash
+	}
+	f, ok := formatters[format]
+	if !ok {
+		return "", nil, 0, fmt.Errorf("unknown format: %s", format)
+	}
+	b, count, err = f.marshal(s, list, query)
+	if err != nil || format != formatClash {
+		return f.contentType, b, count, err
+	}
+	comment := fmt.Sprintf("# generated at %s by clash-mate, %d rules\n", generatedAt.UTC().Format(time.RFC3339), count)
+	return f.contentType, append([]byte(comment), b...), count, nil
+}
+
+// noResolveOf returns whether no-resolve is appended to the ip rules, the
+// no_resolve query overrides the option.
+func (s *gfwlistProvider) noResolveOf(query url.Values) (bool, error) {
+	v := query.Get("no_resolve")
+	if v == "" {
+		return s.noResolve, nil
+	}
+	noResolve, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid no_resolve: %s", v)
+	}
+	return noResolve, nil
+}
+
+// policyOf returns the policy query, which is rejected if it contains a comma
+// or a control character since it would inject another field or rule.
+func policyOf(query url.Values) (string, error) {
+	policy := query.Get("policy")
+	if strings.ContainsFunc(policy, func(r rune) bool { return r == ',' || unicode.IsControl(r) }) {
+		return "", fmt.Errorf("invalid policy: %q", policy)
+	}
+	return policy, nil
+}
+
+// writeBody writes b to the response, it's compressed with gzip when the
+// client accepts it.
+func writeBody(wr http.ResponseWriter, r *http.Request, b []byte) {
+	wr.Header().Add("Vary", "Accept-Encoding")
+	if acceptGzip(r) {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		gw.Write(b)
+		gw.Close()
+		wr.Header().Set("Content-Encoding", "gzip")
+		b = buf.Bytes()
+	}
+	wr.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	writeUnlessHead(wr, r, b)
+}
+
+// writeUnlessHead writes b unless it's a HEAD request, which only checks the
+// headers, e.g. the ETag to know whether the rules changed.
+func writeUnlessHead(wr http.ResponseWriter, r *http.Request, b []byte) {
+	if r.Method == http.MethodHead {
+		return
+	}
+	wr.Write(b)
+}
+
+func acceptGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(encoding, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		if len(parts) > 1 && strings.ReplaceAll(parts[1], " ", "") == "q=0" {
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// marshalClash writes the payload of the rule provider directly to the buffer
+// instead of building and marshaling the whole document, which keeps only one
+// copy of the rules in memory.
+func (s *gfwlistProvider) marshalClash(list ruleList, query url.Values) ([]byte, int, error) {
+	behavior := query.Get("behavior")
+	if behavior == "" {
+		behavior = behaviorClassical
+	}
+	noResolve, err := s.noResolveOf(query)
+	if err != nil {
+		return nil, 0, err
+	}
+	policy, err := policyOf(query)
+	if err != nil {
+		return nil, 0, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString("payload:")
+	var n int
+	item := func(rule string) {
+		if n == 0 {
+			buf.Grow(estimateSize(list))
+			buf.WriteByte('\n')
+		}
+		n++
+		writeYAMLItem(&buf, rule)
+	}
+	switch behavior {
+	case behaviorClassical:
+		s.eachClashRule(list, policy, noResolve, item)
+		// the catch-all rule must be the last one
+		if s.finalPolicy != "" {
+			item("MATCH," + s.finalPolicy)
+		}
+	case behaviorDomain:
+		s.eachDomainRule(list, item)
+	case behaviorIPCIDR:
+		s.eachIPRule(list, item)
+	default:
+		return nil, 0, fmt.Errorf("unknown behavior: %s", behavior)
+	}
+	if n == 0 {
+		buf.WriteString(" []\n")
+	}
+	return buf.Bytes(), n, nil
+}
+
+// estimateSize estimates the size of the rendered rules so the buffer is
+// allocated once.
+func estimateSize(list ruleList) int {
+	n := list.count() * 24
+	for _, domain := range list.domains {
+		n += len(domain)
+	}
+	for _, domain := range list.exacts {
+		n += len(domain)
+	}
+	return n
+}
+
+// writeYAMLItem writes the rule as an item of the yaml sequence, the rule is
+// quoted by yaml only if it's not a plain scalar, which is rare.
+func writeYAMLItem(buf *bytes.Buffer, rule string) {
+	buf.WriteString("- ")
+	if isPlainYAML(rule) {
+		buf.WriteString(rule)
+		buf.WriteByte('\n')
+		return
+	}
+	b, _ := yaml.Marshal(rule)
+	buf.Write(b)
+}
+
+func isPlainYAML(v string) bool {
+	if strings.HasPrefix(v, "+.") {
+		v = v[2:]
+	}
+	if v == "" || !('A' <= v[0] && v[0] <= 'Z' || 'a' <= v[0] && v[0] <= 'z') {
+		return false
+	}
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9':
+		case c == '.', c == ',', c == '-', c == '_', c == '/':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// marshalSurge marshals the rules to the surge ruleset, which is the plain
+// rule lines, surge doesn't support DOMAIN-REGEX so the regexes are skipped.
+func (s *gfwlistProvider) marshalSurge(list ruleList, noResolve bool) ([]byte, int) {
+	list.regexes = nil
+	var buf bytes.Buffer
+	buf.WriteString("# generated by clash-mate\n")
+	buf.Grow(estimateSize(list))
+	var n int
+	s.eachClashRule(list, "", noResolve, func(rule string) {
+		n++
+		buf.WriteString(rule)
+		buf.WriteByte('\n')
+	})
+	return buf.Bytes(), n
+}
+
+// marshalQuantumultX marshals the rules to the quantumult x filter, the policy
+// is appended to each filter and defaults to proxy.
+func (s *gfwlistProvider) marshalQuantumultX(list ruleList, policy string) ([]byte, int) {
+	if policy == "" {
+		policy = defaultQuantumultXPolicy
+	}
+	var buf bytes.Buffer
+	buf.WriteString("# generated by clash-mate\n")
+	for _, domainKeyword := range list.keywords {
+		fmt.Fprintf(&buf, "host-keyword, %s, %s\n", domainKeyword, policy)
+	}
+	for _, ip := range list.ips {
+		cidr, v6 := toCIDR(ip)
+		if v6 {
+			fmt.Fprintf(&buf, "ip6-cidr, %s, %s\n", cidr, policy)
+		} else {
+			fmt.Fprintf(&buf, "ip-cidr, %s, %s\n", cidr, policy)
+		}
+	}
+	for _, domain := range list.exacts {
+		fmt.Fprintf(&buf, "host, %s, %s\n", domain, policy)
+	}
+	for _, domain := range list.domains {
+		fmt.Fprintf(&buf, "host-suffix, %s, %s\n", domain, policy)
+	}
+	return buf.Bytes(), len(list.keywords) + len(list.ips) + len(list.exacts) + len(list.domains)
+}
+
+// singBoxRuleSet is the source format of sing-box rule-set.
+type singBoxRuleSet struct {
+	Version int           `json:"version"`
+	Rules   []singBoxRule `json:"rules"`
+}
+
+type singBoxRule struct {
+	Domain        []string `json:"domain,omitempty"`
+	DomainSuffix  []string `json:"domain_suffix,omitempty"`
+	DomainKeyword []string `json:"domain_keyword,omitempty"`
+	DomainRegex   []string `json:"domain_regex,omitempty"`
+	IPCIDR        []string `json:"ip_cidr,omitempty"`
+}
+
+func (s *gfwlistProvider) marshalSingBox(list ruleList) ([]byte, int, error) {
+	rule := singBoxRule{
+		Domain:        list.exacts,
+		DomainSuffix:  list.domains,
+		DomainKeyword: list.keywords,
+		DomainRegex:   list.regexes,
+	}
+	for _, ip := range list.ips {
+		cidr, _ := toCIDR(ip)
+		rule.IPCIDR = append(rule.IPCIDR, cidr)
+	}
+	b, err := json.Marshal(singBoxRuleSet{
+		Version: 1,
+		Rules:   []singBoxRule{rule},
+	})
+	return b, list.count(), err
+}
+
+// marshalDnsmasq marshals the domains to dnsmasq server lines which resolve
+// them with the given dns, e.g. 127.0.0.1#5353 which should be escaped as
+// 127.0.0.1%235353 in the query. dnsmasq is domain based so the keywords, ips
+// and regexes are skipped, and it always matches the subdomains so the exact
+// domains are rendered as suffixes.
+func (s *gfwlistProvider) marshalDnsmasq(list ruleList, dns string) ([]byte, int, error) {
+	if dns == "" {
+		return nil, 0, fmt.Errorf("dns is required for %s format", formatDnsmasq)
+	}
+	if !isDnsmasqServer(dns) {
+		return nil, 0, fmt.Errorf("invalid dns: %q, it should be ip[#port]", dns)
+	}
+	var buf bytes.Buffer
+	buf.WriteString("# generated by clash-mate\n")
+	for _, domain := range list.exacts {
+		fmt.Fprintf(&buf, "server=/%s/%s\n", domain, dns)
+	}
+	for _, domain := range list.domains {
+		fmt.Fprintf(&buf, "server=/%s/%s\n", domain, dns)
+	}
+	return buf.Bytes(), len(list.exacts) + len(list.domains), nil
+}
+
+// isDnsmasqServer reports whether dns is an ip with an optional #port, so it
+// can't inject other dnsmasq directives.
+func isDnsmasqServer(dns string) bool {
+	host, port, ok := strings.Cut(dns, "#")
+	if !isIP(host) {
+		return false
+	}
+	if !ok {
+		return true
+	}
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535
+}
+
+// marshalLoon marshals the rules to the [Rule] section of loon, which is like
+// surge but the policy is required and defaults to Proxy, the final rule is
+// rendered as FINAL. loon doesn't support DOMAIN-REGEX so the regexes are
+// skipped.
+func (s *gfwlistProvider) marshalLoon(list ruleList, policy string, noResolve bool) ([]byte, int) {
+	if policy == "" {
+		policy = defaultLoonPolicy
+	}
+	list.regexes = nil
+	var buf bytes.Buffer
+	buf.WriteString("# generated by clash-mate\n[Rule]\n")
+	buf.Grow(estimateSize(list))
+	var n int
+	s.eachClashRule(list, policy, noResolve, func(rule string) {
+		n++
+		buf.WriteString(rule)
+		buf.WriteByte('\n')
+	})
+	if s.finalPolicy != "" {
+		n++
+		buf.WriteString("FINAL," + s.finalPolicy + "\n")
+	}
+	return buf.Bytes(), n
+}
+
+// marshalHosts marshals the domains to the hosts file lines pointing them to
+// the sink ip, defaults to 0.0.0.0. The hosts file matches the domains exactly
+// so the suffixes are rendered as the domains themselves, and the keywords, ips
+// and regexes are skipped.
+func (s *gfwlistProvider) marshalHosts(list ruleList, sink string) ([]byte, int, error) {
+	if sink == "" {
+		sink = defaultHostsSink
+	}
+	if !isIP(sink) {
+		return nil, 0, fmt.Errorf("invalid sink: %s", sink)
+	}
+	var buf bytes.Buffer
+	buf.WriteString("# generated by clash-mate\n")
+	for _, domain := range list.exacts {
+		fmt.Fprintf(&buf, "%s %s\n", sink, domain)
+	}
+	for _, domain := range list.domains {
+		fmt.Fprintf(&buf, "%s %s\n", sink, domain)
+	}
+	return buf.Bytes(), len(list.exacts) + len(list.domains), nil
+}
+
+// marshalDomains marshals the domains one per line without any rule prefix.
+func (s *gfwlistProvider) marshalDomains(list ruleList) ([]byte, int) {
+	var buf bytes.Buffer
+	for _, domain := range list.exacts {
+		buf.WriteString(domain)
+		buf.WriteByte('\n')
+	}
+	for _, domain := range list.domains {
+		buf.WriteString(domain)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), len(list.exacts) + len(list.domains)
+}
+
+// eachClashRule renders the classical rules one by one, the policy is appended
+// to each rule when it's not empty so the rules can be used in the rules
+// section.
+func (s *gfwlistProvider) eachClashRule(list ruleList, policy string, noResolve bool, fn func(rule string)) {
+	if policy != "" {
+		policy = "," + policy
+	}
+	var suffix string
+	if noResolve {
+		suffix = ",no-resolve"
+	}
+
+	for _, domainKeyword := range list.keywords {
+		fn("DOMAIN-KEYWORD," + domainKeyword + policy)
+	}
+	for _, ip := range list.ips {
+		cidr, v6 := toCIDR(ip)
+		if v6 {
+			fn("IP-CIDR6," + cidr + policy + suffix)
+		} else {
+			fn("IP-CIDR," + cidr + policy + suffix)
+		}
+	}
+	for _, domain := range list.exacts {
+		fn("DOMAIN," + domain + policy)
+	}
+	for _, domain := range list.domains {
+		fn("DOMAIN-SUFFIX," + domain + policy)
+	}
+	for _, regex := range list.regexes {
+		fn("DOMAIN-REGEX," + regex + policy)
+	}
+}
+
+// eachIPRule renders the rules for the ipcidr behavior provider, which only
+// supports the cidrs so the domains, keywords and regexes are skipped.
+func (s *gfwlistProvider) eachIPRule(list ruleList, fn func(rule string)) {
+	for _, ip := range list.ips {
+		cidr, _ := toCIDR(ip)
+		fn(cidr)
+	}
+}
+
+// eachDomainRule renders the rules for the domain behavior provider, which
+// only supports domains so the keywords, ips and regexes are skipped. The
+// exact domain is rendered as is while the suffix is prefixed with +.
+func (s *gfwlistProvider) eachDomainRule(list ruleList, fn func(rule string)) {
+	for _, domain := range list.exacts {
+		fn(domain)
+	}
+	for _, domain := range list.domains {
+		fn("+." + domain)
+	}
+}
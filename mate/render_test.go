@@ -0,0 +1,85 @@
+package mate
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsDnsmasqServer(test *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"127.0.0.1#5353", true},
+		{"::1#53", true},
+		{"127.0.0.1#0", false},
+		{"127.0.0.1#", false},
+		{"example.com", false},
+		{"1.1.1.1\naddress=/x/1.2.3.4", false},
+		{"1.1.1.1#53\naddress=/x/1.2.3.4", false},
+	}
+	for _, tt := range tests {
+		if got := isDnsmasqServer(tt.in); got != tt.want {
+			test.Errorf("isDnsmasqServer(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyOf(test *testing.T) {
+	tests := []struct {
+		in      string
+		wantErr bool
+	}{
+		{"", false},
+		{"Proxy", false},
+		{"🚀 Proxy", false},
+		{"Proxy,no-resolve", true},
+		{"Proxy\nMATCH,DIRECT", true},
+		{"Proxy\r", true},
+	}
+	for _, tt := range tests {
+		_, err := policyOf(url.Values{"policy": {tt.in}})
+		if (err != nil) != tt.wantErr {
+			test.Errorf("policyOf(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRenderCount(test *testing.T) {
+	s := newGfwlistProvider(WithCacheFile(""))
+	list := ruleList{
+		domains:  []string{"example.com", "example.org"},
+		ips:      []string{"1.2.3.0/24"},
+		keywords: []string{"google"},
+		regexes:  []string{`^ad\.`},
+	}
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"", 5},
+		{"behavior=domain", 2},
+		{"behavior=ipcidr", 1},
+		{"format=surge", 4},
+		{"format=loon", 4},
+		{"format=hosts", 2},
+		{"format=dnsmasq&dns=127.0.0.1", 2},
+		{"format=sing-box", 5},
+	}
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		_, b, n, err := s.render(list, query, time.Now())
+		if err != nil {
+			test.Fatalf("render(%q) failed, %v", tt.query, err)
+		}
+		if n != tt.want {
+			test.Errorf("render(%q) counts %d rules, want %d", tt.query, n, tt.want)
+		}
+		if tt.query == "behavior=domain" && !strings.Contains(string(b), ", 2 rules\n") {
+			test.Errorf("render(%q) = %s, the comment doesn't count the payload", tt.query, b)
+		}
+	}
+}
@@ -1,32 +1,532 @@
 package mate
 
 import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// the default timeouts of the server, which bound the slow clients.
+const (
+	defaultReadTimeout  = 10 * time.Second
+	defaultWriteTimeout = time.Minute
+	defaultIdleTimeout  = 2 * time.Minute
 )
 
 type Server struct {
-	mux *http.ServeMux
+	mux       *http.ServeMux
+	srv       *http.Server
+	logger    *slog.Logger
+	startedAt time.Time
+
+	// pprof serves the profiles on its own listener, nil if it's disabled.
+	pprof *http.Server
+
+	// providerOpts are applied to every provider created from the config,
+	// they're kept for Reload.
+	providerOpts []Option
+
+	// mu guards the providers, the auth and the paths which are replaced on
+	// Reload while serving.
+	mu        sync.RWMutex
+	providers map[string]Provider
+	// routes are the names of the providers whose endpoints are registered,
+	// the endpoints of the removed providers are kept and respond 404.
+	routes map[string]bool
+
+	// basic auth of the provider endpoints, disabled when username is empty.
+	username string
+	password string
+
+	// paths are the registered endpoints, which are listed on 404.
+	paths []string
+
+	// accessLogger logs every request, disabled when it's nil.
+	accessLogger *slog.Logger
+	// corsOrigins are the origins allowed to fetch the rules from the
+	// browsers, * allows any origin, CORS is disabled when it's empty.
+	corsOrigins map[string]bool
+	// limit is the semaphore of the concurrent requests to the rules,
+	// unlimited when it's nil.
+	limit chan struct{}
+}
+
+// NewServer creates the server serving the gfwlist provider with the options.
+func NewServer(opts ...Option) *Server {
+	gfwlist := newGfwlistProvider(opts...)
+	// a single provider has no route to collide with
+	s, _ := newServer(gfwlist.rootLogger, gfwlist)
+	s.providerOpts = opts
+	return s
+}
+
+// NewServerWithConfig creates the server with the config, opts are applied to
+// every provider after the options of the config.
+func NewServerWithConfig(cfg *Config, opts ...Option) (*Server, error) {
+	providers := newProvidersWithConfig(cfg, opts...)
+	logger := providers[0].(*gfwlistProvider).rootLogger
+	s, err := newServer(logger, providers...)
+	if err != nil {
+		return nil, err
+	}
+	s.providerOpts = opts
+	s.SetBasicAuth(cfg.Auth.Username, cfg.Auth.Password)
+	if cfg.AccessLog {
+		s.SetAccessLog(logger)
+	}
+	if cfg.PprofAddr != "" {
+		if err := s.EnablePprof(cfg.PprofAddr); err != nil {
+			return nil, err
+		}
+	}
+	s.SetTimeouts(cfg.ReadTimeout, cfg.WriteTimeout, cfg.IdleTimeout)
+	s.SetMaxConcurrent(cfg.MaxConcurrent)
+	if len(cfg.CORSOrigins) > 0 {
+		s.SetCORSOrigins(cfg.CORSOrigins)
+	}
+	return s, nil
+}
+
+// newProvidersWithConfig creates the default gfwlist provider and the
+// additional providers of the config.
+func newProvidersWithConfig(cfg *Config, opts ...Option) []Provider {
+	providers := []Provider{newGfwlistProvider(append(cfg.ProviderConfig.options(), opts...)...)}
+	for _, pc := range cfg.Providers {
+		providers = append(providers, pc.newProvider(opts...))
+	}
+	return providers
 }
 
-func NewServer() *Server {
+func newServer(logger *slog.Logger, providers ...Provider) (*Server, error) {
 	s := Server{
-		mux: http.NewServeMux(),
+		mux:       http.NewServeMux(),
+		providers: make(map[string]Provider, len(providers)),
+		routes:    make(map[string]bool, len(providers)),
+		logger:    logger,
+		startedAt: time.Now(),
+	}
+	s.srv = &http.Server{
+		Handler:      http.HandlerFunc(s.serveHTTP),
+		ReadTimeout:  defaultReadTimeout,
+		WriteTimeout: defaultWriteTimeout,
+		IdleTimeout:  defaultIdleTimeout,
+	}
+	for _, p := range providers {
+		if err := s.registerProvider(p); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range providers {
+		p.Start(context.Background())
+	}
+	s.handle("/healthz", http.HandlerFunc(s.handleHealthz))
+	s.handle("/readyz", http.HandlerFunc(s.handleReadyz))
+	s.handle("/status", http.HandlerFunc(s.handleStatus))
+	s.handle("/version", http.HandlerFunc(s.handleVersion))
+	s.handle("/metrics", promhttp.Handler())
+	s.mux.HandleFunc("/", s.handleNotFound)
+	return &s, nil
+}
+
+// Reload replaces the providers with the ones of the config while serving,
+// the new providers start with the rules of the old ones with the same name
+// and update immediately. The auth is reloaded too, while the port and the
+// access log are not. The old providers are kept serving if the new ones
+// can't be registered.
+func (s *Server) Reload(cfg *Config) error {
+	providers := newProvidersWithConfig(cfg, s.providerOpts...)
+	s.mu.Lock()
+	old := s.providers
+	s.providers = make(map[string]Provider, len(providers))
+	for _, p := range providers {
+		if gp, ok := p.(*gfwlistProvider); ok {
+			gp.inheritRules(old[p.Name()])
+		}
+		if err := s.registerProvider(p); err != nil {
+			s.providers = old
+			s.mu.Unlock()
+			return fmt.Errorf("reload failed, %w", err)
+		}
+	}
+	s.username = cfg.Auth.Username
+	s.password = cfg.Auth.Password
+	s.mu.Unlock()
+
+	for _, p := range providers {
+		p.Start(context.Background())
+	}
+	for _, p := range old {
+		p.Stop()
+	}
+	s.logger.Info("server reloaded", "event", "reload", "providers", len(providers))
+	return nil
+}
+
+// provider returns the provider of the name, nil if it's removed on Reload.
+func (s *Server) provider(name string) Provider {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.providers[name]
+}
+
+// registerProvider serves the provider on /clash/provider/<name>, the
+// endpoints look up the provider by name on each request so the provider can
+// be replaced on Reload. The routes colliding with the registered ones of
+// another provider, e.g. the provider gfwlist-direct with the direct rules of
+// gfwlist, are rejected since ServeMux panics on them. s.mu must be held if
+// the server is serving.
+func (s *Server) registerProvider(p Provider) error {
+	if _, ok := s.providers[p.Name()]; ok {
+		return fmt.Errorf("duplicated provider: %s", p.Name())
+	}
+	if s.routes[p.Name()] {
+		s.providers[p.Name()] = p
+		return nil
+	}
+	path := "/clash/provider/" + p.Name()
+	routes := map[string]http.Handler{
+		path:              s.wrapperClashHandler(s.dispatch(p.Name(), handleRules)),
+		path + "/refresh": s.wrapperAuthHandler(s.dispatch(p.Name(), handleRefresh)),
+	}
+	if _, ok := p.(directProvider); ok {
+		routes[path+"-direct"] = s.wrapperClashHandler(s.dispatch(p.Name(), handleDirect))
+	}
+	if _, ok := p.(splitProvider); ok {
+		routes[path+"/ip"] = s.wrapperClashHandler(s.dispatch(p.Name(), handleIP))
+		routes[path+"/domain"] = s.wrapperClashHandler(s.dispatch(p.Name(), handleDomain))
+	}
+	if _, ok := p.(rawProvider); ok {
+		routes[path+"/raw"] = s.wrapperAuthHandler(s.dispatch(p.Name(), handleRaw))
+	}
+	for _, registered := range s.paths {
+		if routes[registered] != nil {
+			return fmt.Errorf("the route %s of provider %s is registered already", registered, p.Name())
+		}
+	}
+	s.providers[p.Name()] = p
+	s.routes[p.Name()] = true
+	for route, h := range routes {
+		s.handle(route, h)
+	}
+	return nil
+}
+
+// dispatch serves the request with the current provider of the name.
+func (s *Server) dispatch(name string, h func(p Provider, wr http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(wr http.ResponseWriter, r *http.Request) {
+		p := s.provider(name)
+		if p == nil {
+			s.handleNotFound(wr, r)
+			return
+		}
+		h(p, wr, r)
+	}
+}
+
+func handleRules(p Provider, wr http.ResponseWriter, r *http.Request) {
+	p.Handle(wr, r)
+}
+
+func handleDirect(p Provider, wr http.ResponseWriter, r *http.Request) {
+	if dp, ok := p.(directProvider); ok {
+		dp.HandleDirect(wr, r)
+		return
+	}
+	http.NotFound(wr, r)
+}
+
+func handleIP(p Provider, wr http.ResponseWriter, r *http.Request) {
+	if sp, ok := p.(splitProvider); ok {
+		sp.HandleIP(wr, r)
+		return
+	}
+	http.NotFound(wr, r)
+}
+
+func handleDomain(p Provider, wr http.ResponseWriter, r *http.Request) {
+	if sp, ok := p.(splitProvider); ok {
+		sp.HandleDomain(wr, r)
+		return
+	}
+	http.NotFound(wr, r)
+}
+
+func handleRaw(p Provider, wr http.ResponseWriter, r *http.Request) {
+	if rp, ok := p.(rawProvider); ok {
+		rp.HandleRaw(wr, r)
+		return
+	}
+	http.NotFound(wr, r)
+}
+
+// handle registers the handler on the path and records the path as an
+// available endpoint.
+func (s *Server) handle(path string, h http.Handler) {
+	s.paths = append(s.paths, path)
+	s.mux.Handle(path, h)
+}
+
+// handleNotFound lists the available endpoints for the unknown paths, so the
+// typo is easy to figure out.
+func (s *Server) handleNotFound(wr http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	paths := sortedList(append([]string(nil), s.paths...))
+	s.mu.RUnlock()
+	http.Error(wr, fmt.Sprintf("404 page not found: %s\n\navailable endpoints:\n  %s",
+		r.URL.Path, strings.Join(paths, "\n  ")), http.StatusNotFound)
+}
+
+// handleRefresh updates the rules of the provider on demand.
+func handleRefresh(p Provider, wr http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		wr.Header().Set("Allow", http.MethodPost)
+		http.Error(wr, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if err := p.Refresh(r.Context()); err != nil {
+		http.Error(wr, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	wr.Write([]byte("ok"))
+}
+
+// handleHealthz reports the server is alive.
+func (s *Server) handleHealthz(wr http.ResponseWriter, r *http.Request) {
+	wr.Write([]byte("ok"))
+}
+
+// handleReadyz reports the server is ready once all providers have been
+// updated.
+func (s *Server) handleReadyz(wr http.ResponseWriter, r *http.Request) {
+	for _, p := range s.currentProviders() {
+		if !p.Ready() {
+			http.Error(wr, fmt.Sprintf("%s is not ready", p.Name()), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	wr.Write([]byte("ok"))
+}
+
+// handleStatus reports the status of the server and the providers in json.
+func (s *Server) handleStatus(wr http.ResponseWriter, r *http.Request) {
+	current := s.currentProviders()
+	providers := make(map[string]ProviderStatus, len(current))
+	for _, p := range current {
+		providers[p.Name()] = p.Status()
+	}
+	wr.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(wr).Encode(map[string]interface{}{
+		"started_at": s.startedAt,
+		"uptime":     time.Since(s.startedAt).Round(time.Second).String(),
+		"providers":  providers,
+	})
+}
+
+// currentProviders returns a snapshot of the providers.
+func (s *Server) currentProviders() []Provider {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	providers := make([]Provider, 0, len(s.providers))
+	for _, p := range s.providers {
+		providers = append(providers, p)
+	}
+	return providers
+}
+
+func (s *Server) serveHTTP(wr http.ResponseWriter, r *http.Request) {
+	if s.accessLogger == nil {
+		s.mux.ServeHTTP(wr, r)
+		return
+	}
+	accessLog(s.accessLogger, s.mux).ServeHTTP(wr, r)
+}
+
+// SetAccessLog logs the method, path, status, bytes, remote address and
+// duration of every request to the logger, nil disables it. It should be
+// called before Start.
+func (s *Server) SetAccessLog(logger *slog.Logger) {
+	s.accessLogger = logger
+}
+
+// SetTimeouts sets the read, write and idle timeouts of the server, the zero
+// values keep the defaults. It should be called before Start.
+func (s *Server) SetTimeouts(read, write, idle time.Duration) {
+	if read > 0 {
+		s.srv.ReadTimeout = read
+	}
+	if write > 0 {
+		s.srv.WriteTimeout = write
 	}
-	s.mux.HandleFunc("/clash/provider/gfwlist", s.wrapperClashHandler(newGfwlistProvider().Handle))
-	return &s
+	if idle > 0 {
+		s.srv.IdleTimeout = idle
+	}
+}
+
+// SetBasicAuth protects the provider endpoints with http basic auth, it should
+// be called before Start.
+func (s *Server) SetBasicAuth(username, password string) {
+	s.username = username
+	s.password = password
+}
+
+func (s *Server) checkBasicAuth(r *http.Request) bool {
+	s.mu.RLock()
+	expectedUsername, expectedPassword := s.username, s.password
+	s.mu.RUnlock()
+	if expectedUsername == "" {
+		return true
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(expectedUsername)) == 1
+	passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(expectedPassword)) == 1
+	return usernameMatch && passwordMatch
 }
 
-func (s *Server) wrapperClashHandler(f func(wr http.ResponseWriter)) http.HandlerFunc {
+func (s *Server) wrapperAuthHandler(f http.HandlerFunc) http.HandlerFunc {
 	return func(wr http.ResponseWriter, r *http.Request) {
-		wr.Header().Set("Content-Type", "application/yaml")
-		wr.Header().Set("cache-control", "no-cache")
-		f(wr)
+		if !s.checkBasicAuth(r) {
+			wr.Header().Set("WWW-Authenticate", `Basic realm="clash-mate", charset="UTF-8"`)
+			http.Error(wr, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		f(wr, r)
 	}
 }
 
+// wrapperClashHandler protects the rules endpoint and allows the CORS origins,
+// the content type and the cache control are set by the provider.
+func (s *Server) wrapperClashHandler(f http.HandlerFunc) http.HandlerFunc {
+	return s.wrapperCORSHandler(s.wrapperAuthHandler(s.wrapperLimitHandler(f)))
+}
+
+// limitRetryAfter is the Retry-After in seconds of the requests over the
+// concurrency limit.
+const limitRetryAfter = "1"
+
+// SetMaxConcurrent limits the concurrent requests to the rules, the requests
+// over the limit respond 503, n <= 0 means unlimited. It should be called
+// before Start.
+func (s *Server) SetMaxConcurrent(n int) {
+	if n <= 0 {
+		s.limit = nil
+		return
+	}
+	s.limit = make(chan struct{}, n)
+}
+
+func (s *Server) wrapperLimitHandler(f http.HandlerFunc) http.HandlerFunc {
+	return func(wr http.ResponseWriter, r *http.Request) {
+		if s.limit == nil {
+			f(wr, r)
+			return
+		}
+		select {
+		case s.limit <- struct{}{}:
+			defer func() { <-s.limit }()
+			f(wr, r)
+		default:
+			rejectedTotal.Inc()
+			wr.Header().Set("Retry-After", limitRetryAfter)
+			http.Error(wr, "too many requests, retry later", http.StatusServiceUnavailable)
+		}
+	}
+}
+
+// Start serves on the port until Shutdown is called, it returns nil once the
+// server is shut down.
 func (s *Server) Start(port int) error {
-	log.Printf("Server listened on %d\n", port)
-	return http.ListenAndServe(fmt.Sprintf(":%d", port), s.mux)
+	return s.StartAddr(fmt.Sprintf(":%d", port))
+}
+
+// StartAddr is like Start but listens on the addr, which is either a tcp
+// address like ":9999" or a unix socket like "unix:///run/clash-mate.sock".
+// The stale socket file is removed before listening, and the socket file is
+// removed on Shutdown.
+func (s *Server) StartAddr(addr string) error {
+	ln, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	s.logger.Info("Server listened", "addr", addr, "version", Version, "commit", Commit)
+	return s.serve(s.srv.Serve(ln))
+}
+
+// unixScheme is the prefix of a unix socket address.
+const unixScheme = "unix://"
+
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, unixScheme)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("remove stale socket failed, %w", err)
+		}
+	}
+	// the unix listener removes the socket file when it's closed.
+	return net.Listen("unix", path)
+}
+
+// StartTLS is like Start but serves https with the certificate and key files.
+func (s *Server) StartTLS(port int, certFile, keyFile string) error {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+	s.logger.Info("Server listened with TLS", "port", port, "version", Version, "commit", Commit)
+	return s.serve(s.srv.ServeTLS(ln, certFile, keyFile))
+}
+
+// StartAutoCert is like StartTLS but obtains the certificates of the domains
+// from Let's Encrypt automatically, the certificates are cached in cacheDir.
+// It listens on 443 since the ACME TLS-ALPN challenge requires it.
+func (s *Server) StartAutoCert(cacheDir string, domains ...string) error {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cacheDir),
+	}
+	ln, err := net.Listen("tcp", ":443")
+	if err != nil {
+		return err
+	}
+	s.srv.TLSConfig = m.TLSConfig()
+	s.logger.Info("Server listened with auto cert", "port", 443, "domains", domains, "version", Version, "commit", Commit)
+	return s.serve(s.srv.ServeTLS(ln, "", ""))
+}
+
+func (s *Server) serve(err error) error {
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops updating the providers and gracefully shuts down the server
+// without interrupting in-flight requests.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.srv.Shutdown(ctx)
+	if s.pprof != nil {
+		s.pprof.Close()
+	}
+	for _, p := range s.currentProviders() {
+		p.Stop()
+	}
+	return err
 }
@@ -0,0 +1,29 @@
+package mate
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+)
+
+// the build info, which are injected by -ldflags, e.g.
+//
+//	go build -ldflags "-X github.com/cloverstd/clash-mate/mate.Version=v1.0.0
+//	  -X github.com/cloverstd/clash-mate/mate.Commit=$(git rev-parse HEAD)
+//	  -X github.com/cloverstd/clash-mate/mate.Date=$(date -u +%FT%TZ)"
+var (
+	Version = "dev"
+	Commit  = "unknown"
+	Date    = "unknown"
+)
+
+// handleVersion reports the build info of the running binary.
+func (s *Server) handleVersion(wr http.ResponseWriter, r *http.Request) {
+	wr.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(wr).Encode(map[string]string{
+		"version":    Version,
+		"commit":     Commit,
+		"date":       Date,
+		"go_version": runtime.Version(),
+	})
+}